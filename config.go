@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cmdlineFlags records the flags set on the command line, which take
+// precedence over the -config file
+var cmdlineFlags map[string]bool
+
+// setFlags returns the names of the flags that have been set in fs
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// loadConfigFile reads a config file and sets each flag it names, skipping
+// flags in skip
+func loadConfigFile(fs *flag.FlagSet, path string, skip map[string]bool) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	return applyConfig(fs, f, skip)
+}
+
+// applyConfig reads flag settings in a small subset of TOML: one
+// key = value per line, where the key is a flag name (- or _ separated)
+// and the value is a quoted string, a bare number or boolean, or an array
+// that is joined with commas for list flags. Durations need a unit, as on
+// the command line. Blank lines and lines starting with # are ignored;
+// tables are not supported.
+//
+//	graphite = "graphite.example.com:2003"
+//	tcp-idle-timeout = "5m"
+//	percentiles = [50, 95, 99]
+func applyConfig(fs *flag.FlagSet, r io.Reader, skip map[string]bool) error {
+	s := bufio.NewScanner(r)
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+
+		if i < 1 {
+			return fmt.Errorf("invalid config on line %d: %q", n, line)
+		}
+
+		name := strings.Replace(strings.TrimSpace(line[:i]), "_", "-", -1)
+		value, err := configValue(strings.TrimSpace(line[i+1:]))
+
+		if err != nil {
+			return fmt.Errorf("invalid value for %s on line %d: %v", name, n, err)
+		}
+
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown config key %q on line %d", name, n)
+		}
+
+		if skip[name] {
+			continue
+		}
+
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value for %s on line %d: %v", name, n, err)
+		}
+	}
+
+	return s.Err()
+}
+
+// configValue converts a TOML value to the string form the flag package
+// expects
+func configValue(v string) (string, error) {
+	if strings.HasPrefix(v, "[") {
+		if !strings.HasSuffix(v, "]") {
+			return "", fmt.Errorf("unterminated array %s", v)
+		}
+
+		items := strings.Split(v[1:len(v)-1], ",")
+		values := make([]string, 0, len(items))
+
+		for _, item := range items {
+			item = strings.TrimSpace(item)
+
+			if item == "" {
+				continue
+			}
+
+			s, err := configValue(item)
+
+			if err != nil {
+				return "", err
+			}
+
+			values = append(values, s)
+		}
+
+		return strings.Join(values, ","), nil
+	}
+
+	if strings.HasPrefix(v, `"`) {
+		return strconv.Unquote(v)
+	}
+
+	if strings.HasPrefix(v, "'") {
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", fmt.Errorf("unterminated string %s", v)
+		}
+
+		return v[1 : len(v)-1], nil
+	}
+
+	// Drop a trailing comment after a bare value
+	if i := strings.Index(v, "#"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+
+	if v == "" {
+		return "", fmt.Errorf("missing value")
+	}
+
+	return v, nil
+}
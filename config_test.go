@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+# statsdaemon settings
+listen = ":9125"
+graphite = 'graphite.example.com:2003'
+percentiles = [50, 95, 99.9]
+max_line_length = 1024 # bytes
+flush_interval = "1m"
+debug = true
+`
+
+// testFlagSet returns a flag set with a few of the daemon's flags, declared
+// with the same types
+func testFlagSet(t *testing.T, args ...string) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("listen", ":8125", "")
+	fs.String("graphite", "localhost:2003", "")
+	fs.String("percentiles", "5,95", "")
+	fs.Int("max-line-length", 65536, "")
+	fs.Duration("flush-interval", 10*time.Second, "")
+	fs.Bool("debug", false, "")
+
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	return fs
+}
+
+func TestApplyConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		config string
+		want   map[string]string
+	}{
+		{
+			"file only", nil, testConfig,
+			map[string]string{
+				"listen":          ":9125",
+				"graphite":        "graphite.example.com:2003",
+				"percentiles":     "50,95,99.9",
+				"max-line-length": "1024",
+				"flush-interval":  "1m0s",
+				"debug":           "true",
+			},
+		},
+		{
+			"flags only", []string{"-listen", ":7125", "-percentiles", "99"}, "",
+			map[string]string{
+				"listen":          ":7125",
+				"graphite":        "localhost:2003",
+				"percentiles":     "99",
+				"max-line-length": "65536",
+				"flush-interval":  "10s",
+				"debug":           "false",
+			},
+		},
+		{
+			"flags override file", []string{"-listen", ":7125"}, testConfig,
+			map[string]string{
+				"listen":          ":7125",
+				"graphite":        "graphite.example.com:2003",
+				"percentiles":     "50,95,99.9",
+				"max-line-length": "1024",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		fs := testFlagSet(t, tt.args...)
+		err := applyConfig(fs, strings.NewReader(tt.config), setFlags(fs))
+
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		for name, want := range tt.want {
+			if got := fs.Lookup(name).Value.String(); got != want {
+				t.Errorf("%s: -%s: got %q, want %q", tt.name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"nosuchflag = 1",
+		"debug = notabool",
+		"max-line-length = 1k",
+		"flush-interval = 10",
+		"listen",
+		`listen = "unterminated`,
+		"percentiles = [1, 2",
+		"[graphite]",
+	} {
+		fs := testFlagSet(t)
+
+		if err := applyConfig(fs, strings.NewReader(config), nil); err == nil {
+			t.Errorf("applyConfig(%q): expected error", config)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "statsdaemon.toml")
+	ioutil.WriteFile(path, []byte(testConfig), 0600)
+	fs := testFlagSet(t)
+
+	if err := loadConfigFile(fs, path, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fs.Lookup("graphite").Value.String(); got != "graphite.example.com:2003" {
+		t.Errorf("loadConfigFile: -graphite: got %q", got)
+	}
+
+	if err := loadConfigFile(fs, filepath.Join(dir, "missing"), nil); err == nil {
+		t.Error("loadConfigFile with a missing file: expected error")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// BucketFilter matches bucket names against a list of patterns read from a
+// file, one per line. A pattern ending in a single * with no other glob
+// characters matches any bucket with that prefix; other patterns containing
+// *, ? or [ are globs (see path.Match); anything else must match exactly.
+//
+//	# everything under debug.
+//	debug.*
+//	# per-host request counters
+//	api.*.requests
+type BucketFilter struct {
+	exact    map[string]bool
+	prefixes []string
+	globs    []string
+}
+
+// bucketBlocklist and bucketAllowlist are loaded from -blocklist and
+// -allowlist. A nil filter is an unset list.
+var bucketBlocklist, bucketAllowlist *BucketFilter
+
+// loadBucketFilter reads bucket patterns from a file
+func loadBucketFilter(path string) (*BucketFilter, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return parseBucketFilter(f)
+}
+
+// parseBucketFilter parses one pattern per line. Blank lines and lines
+// starting with # are ignored.
+func parseBucketFilter(r io.Reader) (*BucketFilter, error) {
+	filter := &BucketFilter{exact: make(map[string]bool)}
+	s := bufio.NewScanner(r)
+
+	for n := 1; s.Scan(); n++ {
+		pattern := strings.TrimSpace(s.Text())
+
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		prefix := strings.TrimSuffix(pattern, "*")
+
+		switch {
+		case !strings.ContainsAny(pattern, "*?["):
+			filter.exact[pattern] = true
+		case !strings.ContainsAny(prefix, "*?["):
+			filter.prefixes = append(filter.prefixes, prefix)
+		default:
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern on line %d: %q", n, pattern)
+			}
+
+			filter.globs = append(filter.globs, pattern)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// Match reports whether a bucket matches any of the filter's patterns
+func (f *BucketFilter) Match(bucket string) bool {
+	if f == nil {
+		return false
+	}
+
+	if f.exact[bucket] {
+		return true
+	}
+
+	for _, p := range f.prefixes {
+		if strings.HasPrefix(bucket, p) {
+			return true
+		}
+	}
+
+	for _, g := range f.globs {
+		if ok, _ := path.Match(g, bucket); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterBucket reports whether a bucket should be dropped, counting it in
+// stats.Filtered if so. The blocklist takes precedence: a bucket on both
+// lists is dropped.
+func filterBucket(bucket string) bool {
+	if bucketBlocklist.Match(bucket) ||
+		bucketAllowlist != nil && !bucketAllowlist.Match(bucket) {
+		atomic.AddUint64(&stats.Filtered, 1)
+		return true
+	}
+
+	return false
+}
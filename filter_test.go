@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBucketFilter(t *testing.T) {
+	filter, err := parseBucketFilter(strings.NewReader(`
+# exact
+api.health
+
+debug.*
+api.*.requests
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		bucket string
+		want   bool
+	}{
+		{"api.health", true},
+		{"api.healthz", false},
+		{"debug.anything.at.all", true},
+		{"api.host1.requests", true},
+		{"api.host1.errors", false},
+		{"other", false},
+	}
+
+	for _, tt := range tests {
+		if got := filter.Match(tt.bucket); got != tt.want {
+			t.Errorf("Match(%q): got %v, want %v", tt.bucket, got, tt.want)
+		}
+	}
+
+	if _, err := parseBucketFilter(strings.NewReader("api.[x")); err == nil {
+		t.Error("parseBucketFilter with a bad glob: expected error")
+	}
+}
+
+func TestFilterBucket(t *testing.T) {
+	defer func(b, a *BucketFilter) {
+		bucketBlocklist = b
+		bucketAllowlist = a
+	}(bucketBlocklist, bucketAllowlist)
+
+	block, _ := parseBucketFilter(strings.NewReader("api.debug.*"))
+	allow, _ := parseBucketFilter(strings.NewReader("api.*"))
+
+	tests := []struct {
+		block, allow *BucketFilter
+		input        string
+		want         []string
+	}{
+		// Blocklist only
+		{block, nil, "api.debug.x:1|c\napi.x:1|c\nother:1|c",
+			[]string{"api.x", "other"}},
+		// Allowlist only
+		{nil, allow, "api.debug.x:1|c\napi.x:1|c\nother:1|c",
+			[]string{"api.debug.x", "api.x"}},
+		// The blocklist wins over the allowlist
+		{block, allow, "api.debug.x:1|c\napi.x:1|c\nother:1|c",
+			[]string{"api.x"}},
+	}
+
+	for i, tt := range tests {
+		bucketBlocklist, bucketAllowlist = tt.block, tt.allow
+		before := atomic.LoadUint64(&stats.Filtered)
+
+		var got []string
+
+		for _, m := range collectMetrics([]byte(tt.input), nil) {
+			got = append(got, m.Bucket)
+		}
+
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("test %d: got %v, want %v", i, got, tt.want)
+		}
+
+		filtered := atomic.LoadUint64(&stats.Filtered) - before
+
+		if want := uint64(3 - len(tt.want)); filtered != want {
+			t.Errorf("test %d: Filtered: got %d, want %d", i, filtered, want)
+		}
+	}
+}
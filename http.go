@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"net/http"
+	"net/http/pprof"
+	"reflect"
+	"sync/atomic"
+)
+
+func init() {
+	vars := expvar.NewMap("statsdaemon")
+	vars.Set("stats", expvar.Func(func() interface{} { return stats.Snapshot() }))
+	vars.Set("counters", expvar.Func(func() interface{} {
+		counters.RLock()
+		defer counters.RUnlock()
+		return len(counters.m)
+	}))
+	vars.Set("gauges", expvar.Func(func() interface{} {
+		gauges.RLock()
+		defer gauges.RUnlock()
+		return len(gauges.m)
+	}))
+	vars.Set("timers", expvar.Func(func() interface{} {
+		timers.RLock()
+		defer timers.RUnlock()
+		return len(timers.m)
+	}))
+	vars.Set("distributions", expvar.Func(func() interface{} {
+		distributions.RLock()
+		defer distributions.RUnlock()
+		return len(distributions.m)
+	}))
+}
+
+// Snapshot returns a copy of the stats with each field read atomically
+func (s *Stats) Snapshot() Stats {
+	var snap Stats
+	src := reflect.ValueOf(s).Elem()
+	dst := reflect.ValueOf(&snap).Elem()
+
+	for i := 0; i < src.NumField(); i++ {
+		p := src.Field(i).Addr().Interface().(*uint64)
+		dst.Field(i).SetUint(atomic.LoadUint64(p))
+	}
+
+	return snap
+}
+
+// httpHandler returns the handler for the HTTP server
+func httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/config", configHandler)
+
+	if *enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	return mux
+}
+
+// configHandler returns the value of every flag as a JSON object. Values
+// reflect the -config file and any reload, not just the command line.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) { config[f.Name] = f.Value.String() })
+
+	// A reload applies its settings without changing the flags
+	for name, value := range reloadedFlags() {
+		config[name] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+// ListenHTTP serves the HTTP endpoints
+func ListenHTTP(addr string) error {
+	logInfo("Listening on HTTP", "addr", addr)
+	return http.ListenAndServe(addr, httpHandler())
+}
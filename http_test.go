@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpvar(t *testing.T) {
+	counters.Lock()
+	counters.m = map[string]int64{"a": 1, "b": 2}
+	counters.Unlock()
+
+	defer func() {
+		counters.Lock()
+		counters.m = make(map[string]int64)
+		counters.Unlock()
+	}()
+
+	ts := httptest.NewServer(httpHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/debug/vars")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	var vars struct {
+		Statsdaemon struct {
+			Counters int
+			Stats    Stats
+		}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := vars.Statsdaemon.Counters; got != 2 {
+		t.Errorf("statsdaemon.counters: got %d, want 2", got)
+	}
+
+	if got, want := vars.Statsdaemon.Stats.InvalidMetrics, stats.InvalidMetrics; got != want {
+		t.Errorf("statsdaemon.stats.InvalidMetrics: got %d, want %d", got, want)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	defer func(b bool) { *enablePprof = b }(*enablePprof)
+
+	for _, enabled := range []bool{false, true} {
+		*enablePprof = enabled
+		ts := httptest.NewServer(httpHandler())
+		resp, err := http.Get(ts.URL + "/debug/pprof/")
+		ts.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+		want := http.StatusNotFound
+
+		if enabled {
+			want = http.StatusOK
+		}
+
+		if resp.StatusCode != want {
+			t.Errorf("GET /debug/pprof/ (pprof=%v): got status %d, want %d",
+				enabled, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	defer func(s string) { *listen = s }(*listen)
+	*listen = "127.0.0.1:9125,[::1]:9125"
+
+	ts := httptest.NewServer(httpHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/config")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	var config map[string]string
+
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := config["listen"]; got != *listen {
+		t.Errorf("/config listen: got %q, want %q", got, *listen)
+	}
+
+	if got := config["flush-interval"]; got != flushInterval.String() {
+		t.Errorf("/config flush-interval: got %q, want %q", got, flushInterval.String())
+	}
+
+	resp, err = http.Post(ts.URL+"/config", "application/json", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /config: got status %d, want %d", resp.StatusCode,
+			http.StatusMethodNotAllowed)
+	}
+}
+
+func TestConfigEndpointReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	defer func(c string, set map[string]bool) {
+		*configFile, cmdlineFlags = c, set
+	}(*configFile, cmdlineFlags)
+
+	defer setPercentiles(Percentiles())
+	defer renames.Store(currentRenames())
+	defer reloaded.Store(reloadedFlags())
+
+	path := filepath.Join(dir, "statsdaemon.toml")
+	ioutil.WriteFile(path, []byte("percentiles = [50, 99]\n"), 0600)
+	*configFile = path
+	cmdlineFlags = nil
+
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(httpHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/config")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	var config map[string]string
+
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := config["percentiles"]; got != "50,99" {
+		t.Errorf("/config percentiles after reload: got %q, want %q", got, "50,99")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// KafkaMessage is the value of each message published to -kafka-topic. Each
+// flushed metric is a separate message keyed by its name.
+type KafkaMessage struct {
+	Name      string  `json:"name"`
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// KafkaRecord is a keyed message to publish
+type KafkaRecord struct {
+	Key   []byte
+	Value []byte
+}
+
+// KafkaProducer publishes messages to a Kafka topic
+type KafkaProducer interface {
+	Send(topic string, records []KafkaRecord) error
+	Close() error
+}
+
+// kafkaProducer is the producer used by the kafka backend
+var kafkaProducer KafkaProducer
+
+// saramaProducer is a KafkaProducer backed by a sarama sync producer
+type saramaProducer struct {
+	p sarama.SyncProducer
+}
+
+// newKafkaProducer connects to the Kafka brokers
+func newKafkaProducer(brokers []string) (KafkaProducer, error) {
+	cfg := sarama.NewConfig()
+	cfg.ClientID = "statsdaemon"
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Return.Successes = true
+
+	p, err := sarama.NewSyncProducer(brokers, cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &saramaProducer{p: p}, nil
+}
+
+// Send publishes the records as one batch
+func (s *saramaProducer) Send(topic string, records []KafkaRecord) error {
+	msgs := make([]*sarama.ProducerMessage, len(records))
+
+	for i, r := range records {
+		msgs[i] = &sarama.ProducerMessage{
+			Topic: topic,
+			Key:   sarama.ByteEncoder(r.Key),
+			Value: sarama.ByteEncoder(r.Value),
+		}
+	}
+
+	return s.p.SendMessages(msgs)
+}
+
+// Close closes the underlying producer
+func (s *saramaProducer) Close() error {
+	return s.p.Close()
+}
+
+// kafkaRecords converts a buffer of Graphite plaintext lines into Kafka
+// records
+func kafkaRecords(buf []byte, now int64) []KafkaRecord {
+	var records []KafkaRecord
+
+	for _, m := range newWebhookData(buf, now).Metrics {
+		v, err := strconv.ParseFloat(m.Value, 64)
+
+		if err != nil {
+			continue
+		}
+
+		b, err := json.Marshal(&KafkaMessage{
+			Name:      m.Name,
+			Value:     v,
+			Timestamp: m.Timestamp,
+		})
+
+		if err != nil {
+			continue
+		}
+
+		records = append(records, KafkaRecord{Key: []byte(m.Name), Value: b})
+	}
+
+	return records
+}
+
+// sendKafka publishes the flushed metrics to -kafka-topic
+func sendKafka(p KafkaProducer, buf []byte, now int64) {
+	records := kafkaRecords(buf, now)
+	logInfo("Sending metrics to Kafka", "messages", len(records),
+		"topic", *kafkaTopic)
+	t0 := time.Now()
+
+	if err := p.Send(*kafkaTopic, records); err != nil {
+		logError("Unable to send metrics to Kafka", "topic", *kafkaTopic,
+			"error", err)
+		return
+	}
+
+	logInfo("Finished sending metrics to Kafka", "messages", len(records),
+		"topic", *kafkaTopic, "duration", time.Now().Sub(t0))
+}
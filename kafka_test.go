@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// mockProducer records the messages sent to it
+type mockProducer struct {
+	topic   string
+	records []KafkaRecord
+	err     error
+}
+
+func (m *mockProducer) Send(topic string, records []KafkaRecord) error {
+	m.topic = topic
+	m.records = append(m.records, records...)
+	return m.err
+}
+
+func (m *mockProducer) Close() error { return nil }
+
+func TestSendKafka(t *testing.T) {
+	defer func(s string) { *kafkaTopic = s }(*kafkaTopic)
+	*kafkaTopic = "metrics"
+
+	p := &mockProducer{}
+	sendKafka(p, []byte("mycounter 5 100\nmytimer.mean 1.500000 100\n"), 100)
+
+	if p.topic != "metrics" {
+		t.Errorf("sendKafka: got topic %q, want metrics", p.topic)
+	}
+
+	want := []KafkaMessage{
+		{Name: "mycounter", Value: 5, Timestamp: 100},
+		{Name: "mytimer.mean", Value: 1.5, Timestamp: 100},
+	}
+
+	if len(p.records) != len(want) {
+		t.Fatalf("sendKafka: got %d messages, want %d", len(p.records), len(want))
+	}
+
+	for i, r := range p.records {
+		var got KafkaMessage
+
+		if err := json.Unmarshal(r.Value, &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want[i] || string(r.Key) != want[i].Name {
+			t.Errorf("sendKafka: message %d: got %s=%+v, want %s=%+v",
+				i, r.Key, got, want[i].Name, want[i])
+		}
+	}
+
+	// Send errors are logged, not fatal
+	sendKafka(&mockProducer{err: errors.New("broker down")}, []byte("x 1 100\n"), 100)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// logJSON selects JSON log entries instead of text (see -log-format)
+var logJSON bool
+
+// setupLogging configures the log output for a -log-format value
+func setupLogging(format string) error {
+	switch format {
+	case "text":
+		logJSON = false
+		log.SetFlags(log.LstdFlags)
+	case "json":
+		// JSON entries carry their own timestamp
+		logJSON = true
+		log.SetFlags(0)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	return nil
+}
+
+func logDebug(msg string, kv ...interface{}) { logEvent("debug", msg, kv...) }
+func logInfo(msg string, kv ...interface{})  { logEvent("info", msg, kv...) }
+func logWarn(msg string, kv ...interface{})  { logEvent("warn", msg, kv...) }
+func logError(msg string, kv ...interface{}) { logEvent("error", msg, kv...) }
+
+// logFatal logs an entry and exits
+func logFatal(msg string, kv ...interface{}) {
+	logEvent("fatal", msg, kv...)
+	os.Exit(1)
+}
+
+// logEvent writes a log entry with alternating key/value fields. Text
+// entries look like "ERROR: Unable to connect: host=x error=y" (info
+// entries have no level prefix); JSON entries have time, level and msg
+// fields followed by the given fields in order.
+func logEvent(level, msg string, kv ...interface{}) {
+	var buf bytes.Buffer
+
+	if logJSON {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, time.Now().Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level)
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+
+		for i := 0; i+1 < len(kv); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(&buf, fmt.Sprint(kv[i]))
+			buf.WriteByte(':')
+			writeJSON(&buf, logValue(kv[i+1]))
+		}
+
+		buf.WriteByte('}')
+	} else {
+		if level != "info" {
+			buf.WriteString(strings.ToUpper(level))
+			buf.WriteString(": ")
+		}
+
+		buf.WriteString(msg)
+
+		for i := 0; i+1 < len(kv); i += 2 {
+			if i == 0 {
+				buf.WriteString(":")
+			}
+
+			fmt.Fprintf(&buf, " %v=%+v", kv[i], kv[i+1])
+		}
+	}
+
+	log.Print(buf.String())
+}
+
+// logValue converts a field value to something that encodes usefully as
+// JSON
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return v
+}
+
+// writeJSON writes v to the buffer as JSON, falling back to its string
+// form if it can't be encoded
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprintf("%+v", v))
+	}
+
+	buf.Write(b)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer setupLogging("text")
+
+	if err := setupLogging("json"); err != nil {
+		t.Fatal(err)
+	}
+
+	logInfo("Finished sending metrics to Graphite", "bytes", 42,
+		"host", "localhost:2003", "duration", 1500*time.Millisecond)
+	logError("Unable to connect to graphite", "error", errors.New("refused"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2: %q", len(lines), buf.String())
+	}
+
+	var entry struct {
+		Time     string
+		Level    string
+		Msg      string
+		Bytes    int
+		Host     string
+		Duration string
+		Error    string
+	}
+
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("unable to unmarshal %q: %s", lines[0], err)
+	}
+
+	if entry.Level != "info" || entry.Msg != "Finished sending metrics to Graphite" ||
+		entry.Bytes != 42 || entry.Host != "localhost:2003" ||
+		entry.Duration != "1.5s" || entry.Time == "" {
+		t.Errorf("unexpected log entry %+v from %q", entry, lines[0])
+	}
+
+	entry.Error = ""
+
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("unable to unmarshal %q: %s", lines[1], err)
+	}
+
+	if entry.Level != "error" || entry.Error != "refused" {
+		t.Errorf("unexpected log entry %+v from %q", entry, lines[1])
+	}
+}
+
+func TestLogText(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer log.SetOutput(os.Stderr)
+	defer setupLogging("text")
+
+	logInfo("Sending metrics to Graphite", "bytes", 42, "host", "localhost:2003")
+	logError("Unable to write to graphite", "error", errors.New("broken pipe"))
+	logDebug("Done")
+
+	want := "Sending metrics to Graphite: bytes=42 host=localhost:2003\n" +
+		"ERROR: Unable to write to graphite: error=broken pipe\n" +
+		"DEBUG: Done\n"
+
+	if buf.String() != want {
+		t.Errorf("text log: got %q, want %q", buf.String(), want)
+	}
+}
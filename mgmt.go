@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ListenMgmt serves the line oriented management interface
+func ListenMgmt(addr string) error {
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	defer l.Close()
+	logInfo("Listening on management TCP", "addr", l.Addr())
+
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return err
+		}
+
+		go handleMgmt(conn)
+	}
+}
+
+// handleMgmt runs management commands from a single connection until it
+// sends quit or disconnects. Each reply is terminated by an END line.
+func handleMgmt(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	s := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch cmd := fields[0]; {
+		case cmd == "quit":
+			return
+		case cmd == "help":
+			fmt.Fprintln(w, "Commands: stats, counters, gauges, timers, distributions, delete [type] <bucket>, quit")
+		case cmd == "stats":
+			mgmtStats(w)
+		case cmd == "counters":
+			mgmtCounters(w)
+		case cmd == "gauges":
+			mgmtGauges(w)
+		case cmd == "timers":
+			mgmtTimers(w, "timers")
+		case cmd == "distributions":
+			mgmtTimers(w, "distributions")
+		case cmd == "delete" && len(fields) == 2:
+			if deleteBucket(fields[1]) {
+				fmt.Fprintf(w, "deleted: %s\n", fields[1])
+			} else {
+				fmt.Fprintf(w, "ERROR: unknown bucket %s\n", fields[1])
+			}
+		case cmd == "delete" && len(fields) == 3:
+			found, err := deleteTypedBucket(fields[1], fields[2])
+
+			switch {
+			case err != nil:
+				fmt.Fprintf(w, "ERROR: %s\n", err)
+			case found:
+				fmt.Fprintf(w, "deleted: %s %s\n", fields[1], fields[2])
+			default:
+				fmt.Fprintf(w, "ERROR: unknown %s bucket %s\n", fields[1], fields[2])
+			}
+		default:
+			fmt.Fprintf(w, "ERROR: unknown command %q\n", s.Text())
+		}
+
+		fmt.Fprintln(w, "END")
+
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// mgmtStats writes each Stats field as "name: value"
+func mgmtStats(w io.Writer) {
+	snap := stats.Snapshot()
+	v := reflect.ValueOf(snap)
+
+	for i := 0; i < v.NumField(); i++ {
+		fmt.Fprintf(w, "%s: %d\n", v.Type().Field(i).Name, v.Field(i).Uint())
+	}
+}
+
+// mgmtCounters writes the current counters as "bucket: value", including
+// those still held in the -fast-counters shards
+func mgmtCounters(w io.Writer) {
+	counters.Lock()
+	defer counters.Unlock()
+	mergeCounterShardsLocked()
+
+	for _, k := range sortedKeys(counters.m) {
+		fmt.Fprintf(w, "%s: %d\n", k, counters.m[k])
+	}
+}
+
+// mgmtGauges writes the current gauges as "bucket: value"
+func mgmtGauges(w io.Writer) {
+	gauges.RLock()
+	defer gauges.RUnlock()
+
+	for _, k := range sortedKeys(gauges.m) {
+		fmt.Fprintf(w, "%s: %v\n", k, gauges.m[k])
+	}
+}
+
+// mgmtTimers writes the values received for each timer or distribution as
+// "bucket: [values]". Timers aggregated with -timer-algorithm=tdigest are
+// summarized instead, since their values aren't kept.
+func mgmtTimers(w io.Writer, kind string) {
+	var m map[string]Timers
+	var digests map[string]*TDigest
+
+	if kind == "timers" {
+		timers.RLock()
+		defer timers.RUnlock()
+		m = timers.m
+		digests = timers.digests
+	} else {
+		distributions.RLock()
+		defer distributions.RUnlock()
+		m = distributions.m
+	}
+
+	for _, k := range sortedKeys(m) {
+		if d := digests[k]; d != nil {
+			fmt.Fprintf(w, "%s: tdigest count=%v min=%v max=%v mean=%v\n", k,
+				d.Count(), d.Min(), d.Max(), d.Mean())
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: %v\n", k, m[k])
+	}
+}
+
+// sortedKeys returns the keys of a metric map in order
+func sortedKeys(m interface{}) []string {
+	var keys []string
+
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// bucketKinds lists the metric types accepted by "delete <type> <bucket>"
+var bucketKinds = []string{"counters", "gauges", "timers", "distributions"}
+
+// deleteBucket removes a bucket from every metric map. It reports whether
+// the bucket was found.
+func deleteBucket(bucket string) bool {
+	found := false
+
+	for _, kind := range bucketKinds {
+		if ok, _ := deleteTypedBucket(kind, bucket); ok {
+			found = true
+		}
+	}
+
+	return found
+}
+
+// deleteTypedBucket removes a bucket from the map for one metric type,
+// holding its write lock so a concurrent flush sees it either before or
+// after the delete. It reports whether the bucket was found.
+func deleteTypedBucket(kind, bucket string) (bool, error) {
+	switch kind {
+	case "counters":
+		counters.Lock()
+		defer counters.Unlock()
+
+		// Otherwise the shards would bring the counter back at the next
+		// flush
+		mergeCounterShardsLocked()
+
+		if _, ok := counters.m[bucket]; !ok {
+			return false, nil
+		}
+
+		delete(counters.m, bucket)
+		delete(counters.rates, bucket)
+		delete(counters.raw, bucket)
+		delete(counters.idle, bucket)
+		delete(counters.window, bucket)
+	case "gauges":
+		gauges.Lock()
+		defer gauges.Unlock()
+
+		if _, ok := gauges.m[bucket]; !ok {
+			return false, nil
+		}
+
+		delete(gauges.m, bucket)
+		delete(gauges.min, bucket)
+		delete(gauges.max, bucket)
+		delete(gauges.sum, bucket)
+		delete(gauges.count, bucket)
+		delete(gauges.times, bucket)
+	case "timers":
+		timers.Lock()
+		defer timers.Unlock()
+
+		if _, ok := timers.m[bucket]; !ok {
+			return false, nil
+		}
+
+		delete(timers.m, bucket)
+		delete(timers.dropped, bucket)
+		delete(timers.sampled, bucket)
+		delete(timers.digests, bucket)
+	case "distributions":
+		distributions.Lock()
+		defer distributions.Unlock()
+
+		if _, ok := distributions.m[bucket]; !ok {
+			return false, nil
+		}
+
+		delete(distributions.m, bucket)
+	default:
+		return false, fmt.Errorf("unknown type %s", kind)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// mgmtCommand sends a command to the management interface and returns the
+// reply lines before END
+func mgmtCommand(t *testing.T, conn net.Conn, r *bufio.Reader, cmd string) []string {
+	fmt.Fprintln(conn, cmd)
+
+	var lines []string
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			t.Fatalf("%s: %s", cmd, err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+
+		if line == "END" {
+			return lines
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+func TestMgmt(t *testing.T) {
+	resetMetrics()
+	defer resetMetrics()
+
+	counters.m["b.counter"] = 3
+	counters.m["a.counter"] = 5
+	gauges.m["mygauge"] = 1.5
+	timers.m["mytimer"] = Timers{1, 2}
+	stats.RecvMetrics = 4
+
+	// A -timer-algorithm=tdigest timer keeps no values
+	timers.m["dtimer"] = nil
+	timers.digests["dtimer"] = NewTDigest(defaultCompression)
+	timers.digests["dtimer"].Add(1)
+	timers.digests["dtimer"].Add(3)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleMgmt(server)
+
+	r := bufio.NewReader(client)
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"counters", []string{"a.counter: 5", "b.counter: 3"}},
+		{"gauges", []string{"mygauge: 1.5"}},
+		{"timers", []string{"dtimer: tdigest count=2 min=1 max=3 mean=2", "mytimer: [1 2]"}},
+		{"delete a.counter", []string{"deleted: a.counter"}},
+		{"delete a.counter", []string{"ERROR: unknown bucket a.counter"}},
+		{"counters", []string{"b.counter: 3"}},
+		{"delete mytimer", []string{"deleted: mytimer"}},
+		{"delete dtimer", []string{"deleted: dtimer"}},
+		{"timers", nil},
+		{"bogus", []string{`ERROR: unknown command "bogus"`}},
+	}
+
+	for _, tt := range tests {
+		got := mgmtCommand(t, client, r, tt.cmd)
+
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	found := false
+
+	for _, line := range mgmtCommand(t, client, r, "stats") {
+		if line == "RecvMetrics: 4" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Error("stats: RecvMetrics not reported")
+	}
+
+	// quit closes the connection
+	fmt.Fprintln(client, "quit")
+
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("quit: connection still open")
+	}
+}
+
+func TestMgmtFastCounters(t *testing.T) {
+	defer func(f bool) { *fastCounters = f }(*fastCounters)
+	*fastCounters = true
+	resetMetrics()
+	defer resetMetrics()
+
+	collectMetrics([]byte("fast:2|c\nother:1|c"), nil)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleMgmt(server)
+
+	r := bufio.NewReader(client)
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"counters", []string{"fast: 2", "other: 1"}},
+		{"delete counters fast", []string{"deleted: counters fast"}},
+		{"counters", []string{"other: 1"}},
+	}
+
+	for _, tt := range tests {
+		got := mgmtCommand(t, client, r, tt.cmd)
+
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	// The deleted counter doesn't come back from the shards
+	mergeCounterShards()
+
+	if _, ok := counters.m["fast"]; ok {
+		t.Error("deleted counter merged back from the shards")
+	}
+}
+
+func TestMgmtDeleteTyped(t *testing.T) {
+	resetMetrics()
+	defer resetMetrics()
+
+	processMetric(&Metric{Bucket: "stuck", Value: 7, Type: Gauge})
+	processMetric(&Metric{Bucket: "stuck", CountValue: 2, Type: Counter})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleMgmt(server)
+
+	r := bufio.NewReader(client)
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"delete gauges stuck", []string{"deleted: gauges stuck"}},
+		{"delete gauges stuck", []string{"ERROR: unknown gauges bucket stuck"}},
+		{"delete widgets stuck", []string{"ERROR: unknown type widgets"}},
+		{"counters", []string{"stuck: 2"}},
+	}
+
+	for _, tt := range tests {
+		got := mgmtCommand(t, client, r, tt.cmd)
+
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if n := flushGauges(&buf, 100); n != 0 || buf.Len() != 0 {
+		t.Errorf("flushGauges after delete: got n=%d %q, want nothing", n, buf.String())
+	}
+}
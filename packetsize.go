@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// packetSizes estimates the distribution of the sizes of received UDP
+// datagrams and TCP lines for -track-packet-size. A t-digest keeps the
+// memory used fixed however many packets arrive in an interval.
+var packetSizes = struct {
+	sync.Mutex
+	d *TDigest
+}{d: NewTDigest(defaultCompression)}
+
+// recordPacketSize adds the size of a received datagram or line
+func recordPacketSize(n int) {
+	if !*trackPacketSize {
+		return
+	}
+
+	packetSizes.Lock()
+	packetSizes.d.Add(float64(n))
+	packetSizes.Unlock()
+}
+
+// flushPacketSizes writes the packet size count, mean, bounds and
+// percentiles received since the last flush as internal stats
+func flushPacketSizes(buf *bytes.Buffer, now int64) {
+	if !*trackPacketSize {
+		return
+	}
+
+	packetSizes.Lock()
+	d := packetSizes.d
+	packetSizes.d = NewTDigest(defaultCompression)
+	packetSizes.Unlock()
+
+	if d.Count() == 0 {
+		return
+	}
+
+	writeInternal(buf, "packet_size.count", d.Count(), now)
+	writeInternal(buf, "packet_size.mean", d.Mean(), now)
+	writeInternal(buf, "packet_size.lower", d.Min(), now)
+	writeInternal(buf, "packet_size.upper", d.Max(), now)
+
+	pcts := Percentiles()
+
+	for j, name := range percentileNames("."+*percentileSuffix, pcts) {
+		writeInternal(buf, "packet_size"+name, d.Quantile(pcts[j]/100), now)
+	}
+}
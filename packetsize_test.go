@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPacketSizes(t *testing.T) {
+	defer func(b bool) { *trackPacketSize = b }(*trackPacketSize)
+	defer func(m map[string]bool) { internalStats = m }(internalStats)
+	defer setPercentiles(Percentiles())
+	*trackPacketSize = true
+	setPercentiles([]float64{50, 90})
+	internalStats = map[string]bool{
+		"packet_size.count":  true,
+		"packet_size.lower":  true,
+		"packet_size.upper":  true,
+		"packet_size.perc50": true,
+		"packet_size.perc90": true,
+	}
+
+	flushPacketSizes(&bytes.Buffer{}, 0)
+
+	// 100 lines of 6 to 105 bytes, each with its newline
+	client, server := net.Pipe()
+	done := make(chan bool)
+
+	go func() {
+		handleConnection(server, "")
+		done <- true
+	}()
+
+	go func() {
+		for i := 1; i <= 100; i++ {
+			fmt.Fprintf(client, "%s:1|c\n", strings.Repeat("x", i))
+		}
+
+		client.Close()
+	}()
+
+	for i := 0; i < 100; i++ {
+		<-In
+	}
+
+	<-done
+
+	var buf bytes.Buffer
+	flushInternalStats(&buf, 100)
+
+	want := "statsd.packet_size.count 100 100\n" +
+		"statsd.packet_size.lower 6 100\n" +
+		"statsd.packet_size.upper 105 100\n" +
+		"statsd.packet_size.perc50 55.5 100\n" +
+		"statsd.packet_size.perc90 95.5 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushInternalStats: got %q, want %q", got, want)
+	}
+
+	// The sizes start again each flush
+	buf.Reset()
+	flushInternalStats(&buf, 110)
+
+	if buf.Len() != 0 {
+		t.Errorf("flushInternalStats: got %q after an empty interval", buf.String())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// prometheusName converts a bucket into a valid Prometheus metric name by
+// replacing characters outside [a-zA-Z0-9_:] with underscores
+func prometheusName(bucket string) string {
+	b := []byte(bucket)
+
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
+
+// formatPrometheus converts a buffer of Graphite plaintext lines into the
+// Prometheus text exposition format. Timestamps are dropped since the
+// Pushgateway rejects them, and buckets that collide once converted keep
+// only the first value.
+func formatPrometheus(buf []byte, now int64) []byte {
+	var out bytes.Buffer
+	seen := make(map[string]bool)
+
+	for _, m := range newWebhookData(buf, now).Metrics {
+		name := prometheusName(m.Name)
+
+		if seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		fmt.Fprintf(&out, "# TYPE %s untyped\n%s %s\n", name, name, m.Value)
+	}
+
+	return out.Bytes()
+}
+
+// pushgatewayEndpoint returns the URL metrics are pushed to for a job
+func pushgatewayEndpoint(base, job string) string {
+	return strings.TrimRight(base, "/") + "/metrics/job/" + url.PathEscape(job)
+}
+
+// sendPushgateway pushes the flushed metrics to the Pushgateway, retrying
+// failed requests. A full flush is PUT, replacing the metrics previously
+// pushed for the job. A flush of only some sections (see the per-type flush
+// intervals) is POSTed, which replaces only the metrics it names, so it
+// doesn't erase the sections flushed on other intervals.
+func sendPushgateway(buf []byte, now int64, full bool) {
+	body := formatPrometheus(buf, now)
+	endpoint := pushgatewayEndpoint(*pushgatewayURL, *pushgatewayJob)
+	client := &http.Client{Timeout: *webhookTimeout}
+	method := "PUT"
+	t0 := time.Now()
+
+	if !full {
+		method = "POST"
+	}
+
+	err := withRetries("Pushgateway", *webhookRetries, func() error {
+		return pushPushgateway(client, method, endpoint, body)
+	})
+
+	if err != nil {
+		logError("Unable to send metrics to Pushgateway", "url", endpoint,
+			"error", err)
+		return
+	}
+
+	logInfo("Finished sending metrics to Pushgateway", "bytes", len(body),
+		"url", endpoint, "duration", time.Now().Sub(t0))
+}
+
+// pushPushgateway makes a single Pushgateway request
+func pushPushgateway(client *http.Client, method, endpoint string, body []byte) error {
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrometheusName(t *testing.T) {
+	for bucket, want := range map[string]string{
+		"api.requests":       "api_requests",
+		"db:query-time.p95":  "db:query_time_p95",
+		"5xx.errors":         "_xx_errors",
+		"already_valid_name": "already_valid_name",
+	} {
+		if got := prometheusName(bucket); got != want {
+			t.Errorf("prometheusName(%q): got %q, want %q", bucket, got, want)
+		}
+	}
+}
+
+func TestSendPushgateway(t *testing.T) {
+	var requests int
+	var method, path, body string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		// Fail the first request to exercise the retry
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		b, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(b)
+	}))
+	defer ts.Close()
+
+	defer func(u, job string, d time.Duration) {
+		*pushgatewayURL = u
+		*pushgatewayJob = job
+		webhookRetryDelay = d
+	}(*pushgatewayURL, *pushgatewayJob, webhookRetryDelay)
+
+	*pushgatewayURL = ts.URL + "/"
+	*pushgatewayJob = "batch jobs"
+	webhookRetryDelay = time.Millisecond
+	sendPushgateway([]byte("api.requests 3 100\napi_requests 4 100\n"+
+		"db.query.mean 2.500000 100\n"), 100, true)
+
+	if requests != 2 {
+		t.Errorf("sendPushgateway: got %d requests, want 2", requests)
+	}
+
+	if method != "PUT" || path != "/metrics/job/batch jobs" {
+		t.Errorf("sendPushgateway: got %s %s, want PUT /metrics/job/batch jobs",
+			method, path)
+	}
+
+	want := "# TYPE api_requests untyped\napi_requests 3\n" +
+		"# TYPE db_query_mean untyped\ndb_query_mean 2.500000\n"
+
+	if body != want {
+		t.Errorf("sendPushgateway: got body %q, want %q", body, want)
+	}
+}
+
+func TestPushgatewaySplitFlush(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	defer func(u, addr string, split, noInternal bool) {
+		*pushgatewayURL, *graphite, *splitFlush, *noInternalStats = u, addr, split, noInternal
+	}(*pushgatewayURL, *graphite, *splitFlush, *noInternalStats)
+
+	// Graphite refuses the connection; only the Pushgateway matters here
+	*pushgatewayURL = ts.URL
+	*graphite = "127.0.0.1:1"
+	*splitFlush = true
+	*noInternalStats = true
+	resetMetrics()
+	defer resetMetrics()
+
+	processMetric(&Metric{Bucket: "hits", CountValue: 1, Type: Counter})
+	processMetric(&Metric{Bucket: "depth", Value: 2, Type: Gauge})
+	flushMetrics(flushSections)
+	asyncSends.Wait()
+
+	// Each push replaces the last, so the sections go in a single push
+	want := "# TYPE hits untyped\nhits 1\n# TYPE depth untyped\ndepth 2\n"
+
+	if len(bodies) != 1 || bodies[0] != want {
+		t.Errorf("pushes: got %q, want [%q]", bodies, want)
+	}
+}
+
+func TestPushgatewayPartialFlush(t *testing.T) {
+	var mu sync.Mutex
+	var methods []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	defer func(u, addr string) {
+		*pushgatewayURL, *graphite = u, addr
+	}(*pushgatewayURL, *graphite)
+
+	*pushgatewayURL = ts.URL
+	*graphite = "127.0.0.1:1"
+	resetMetrics()
+	defer resetMetrics()
+
+	// A flush of only some sections mustn't replace the others
+	flushMetrics(flushSections)
+	asyncSends.Wait()
+	flushMetrics([]string{"counters"})
+	asyncSends.Wait()
+
+	if want := []string{"PUT", "POST"}; !reflect.DeepEqual(methods, want) {
+		t.Errorf("push methods: got %v, want %v", methods, want)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimitIdle is how long a source can be idle before its bucket is
+// removed
+const rateLimitIdle = time.Minute
+
+// RateLimiter limits the number of metrics per second accepted from each
+// source IP using a token bucket per IP. Each bucket holds up to one second
+// worth of tokens, so a source may burst up to the rate. Rates below 1 still
+// hold one token, or no metric would ever be accepted.
+type RateLimiter struct {
+	sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+
+	// now returns the current time (replaceable for tests)
+	now func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is the per-IP rate limiter, or nil if -max-rate-per-ip is not set
+var limiter *RateLimiter
+
+// NewRateLimiter creates a rate limiter allowing rate metrics per second
+// per IP
+func NewRateLimiter(rate float64) *RateLimiter {
+	return &RateLimiter{
+		rate:      rate,
+		burst:     math.Max(rate, 1),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether another metric from ip may be accepted
+func (l *RateLimiter) Allow(ip string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[ip]
+
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	// Refill for the time since the last metric, up to the burst size
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	b.last = now
+
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// sweep removes buckets for sources that have been idle long enough to
+// have refilled, so the map doesn't grow with every IP ever seen
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitIdle {
+		return
+	}
+
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) >= rateLimitIdle {
+			delete(l.buckets, ip)
+		}
+	}
+
+	l.lastSweep = now
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(10)
+	l.now = func() time.Time { return now }
+	l.lastSweep = now
+
+	allowed := func(ip string, n int) int {
+		var a int
+
+		for i := 0; i < n; i++ {
+			if l.Allow(ip) {
+				a++
+			}
+		}
+
+		return a
+	}
+
+	// Burst up to the rate
+	if got := allowed("10.0.0.1", 15); got != 10 {
+		t.Errorf("burst: got %d allowed, want 10", got)
+	}
+
+	// Other sources have their own bucket
+	if got := allowed("10.0.0.2", 5); got != 5 {
+		t.Errorf("second source: got %d allowed, want 5", got)
+	}
+
+	// Steady state refills at the rate
+	for i := 0; i < 4; i++ {
+		now = now.Add(500 * time.Millisecond)
+
+		if got := allowed("10.0.0.1", 10); got != 5 {
+			t.Errorf("steady state: got %d allowed, want 5", got)
+		}
+	}
+
+	// Idle sources are cleaned up
+	now = now.Add(2 * rateLimitIdle)
+	allowed("10.0.0.3", 1)
+
+	if len(l.buckets) != 1 {
+		t.Errorf("sweep: got %d buckets, want 1", len(l.buckets))
+	}
+}
+
+func TestRateLimiterFractional(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(0.5)
+	l.now = func() time.Time { return now }
+	l.lastSweep = now
+
+	// One metric every two seconds
+	for i, tt := range []struct {
+		after time.Duration
+		want  bool
+	}{
+		{0, true},
+		{0, false},
+		{time.Second, false},
+		{time.Second, true},
+		{10 * time.Second, true},
+		{0, false},
+	} {
+		now = now.Add(tt.after)
+
+		if got := l.Allow("10.0.0.1"); got != tt.want {
+			t.Errorf("metric %d: got allowed %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestHandleMessageRateLimited(t *testing.T) {
+	defer func(l *RateLimiter) { limiter = l }(limiter)
+	limiter = NewRateLimiter(2)
+
+	before := atomic.LoadUint64(&stats.RateLimited)
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	got := collectMetrics([]byte("a:1|c\nb:1|c\nc:1|c\nd:1|c"), src)
+
+	if len(got) != 2 {
+		t.Errorf("handleMessage: got %d metrics, want 2", len(got))
+	}
+
+	if got := atomic.LoadUint64(&stats.RateLimited) - before; got != 2 {
+		t.Errorf("RateLimited: got %d, want 2", got)
+	}
+}
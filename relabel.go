@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync/atomic"
+)
+
+// RelabelRule transforms bucket names at flush time, modeled on Prometheus
+// relabel_configs. The regex is anchored at both ends and matched against
+// the bucket name.
+//
+//	replace: rename matching buckets to the expanded replacement ($1 etc.)
+//	keep:    drop buckets that don't match
+//	drop:    drop buckets that match
+//
+// Rules are read from a JSON file holding a list of rules, e.g.
+//
+//	[{"action": "drop", "regex": "debug\\..*"},
+//	 {"action": "replace", "regex": "web\\d+\\.(.*)", "replacement": "web.$1"}]
+type RelabelRule struct {
+	Action      string `json:"action"`
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// relabels holds the rules loaded from -relabel-config, if any
+var relabels []*RelabelRule
+
+// loadRelabelRules reads relabel rules from a file
+func loadRelabelRules(path string) ([]*RelabelRule, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return parseRelabelRules(f)
+}
+
+// parseRelabelRules parses a JSON list of relabel rules, filling in the
+// Prometheus defaults (action replace, regex (.*), replacement $1)
+func parseRelabelRules(r io.Reader) ([]*RelabelRule, error) {
+	var rules []*RelabelRule
+
+	if err := json.NewDecoder(r).Decode(&rules); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if rule.Action == "" {
+			rule.Action = "replace"
+		}
+
+		if rule.Regex == "" {
+			rule.Regex = "(.*)"
+		}
+
+		if rule.Replacement == "" && rule.Action == "replace" {
+			rule.Replacement = "$1"
+		}
+
+		switch rule.Action {
+		case "replace", "keep", "drop":
+		default:
+			return nil, fmt.Errorf("unknown relabel action %q", rule.Action)
+		}
+
+		re, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+
+		if err != nil {
+			return nil, err
+		}
+
+		rule.re = re
+	}
+
+	return rules, nil
+}
+
+// relabel applies the relabel rules to a bucket name in order, returning
+// the new name and false if the bucket should be dropped. A replacement
+// that isn't a valid bucket name is sanitized under -sanitize, or dropped
+// and counted in stats.RelabelDropped. Gauges persist, so they are counted
+// again at every flush.
+func relabel(bucket string) (string, bool) {
+	replaced := false
+
+	for _, rule := range relabels {
+		match := rule.re.FindStringSubmatchIndex(bucket)
+
+		switch rule.Action {
+		case "keep":
+			if match == nil {
+				return "", false
+			}
+		case "drop":
+			if match != nil {
+				return "", false
+			}
+		case "replace":
+			if match != nil {
+				bucket = string(rule.re.ExpandString(nil, rule.Replacement,
+					bucket, match))
+				replaced = true
+			}
+		}
+	}
+
+	if !replaced {
+		return bucket, true
+	}
+
+	bucket, err := checkBucket([]byte(bucket))
+
+	if err != nil {
+		atomic.AddUint64(&stats.RelabelDropped, 1)
+		return "", false
+	}
+
+	return bucket, true
+}
+
+// relabelUnique relabels a bucket like relabel, but drops it if an earlier
+// bucket of the same flush was already relabeled to the same name, so the
+// flush doesn't write duplicate lines. Dropped duplicates are counted in
+// stats.RelabelDropped.
+func relabelUnique(seen map[string]bool, k string) (string, bool) {
+	bucket, ok := relabel(k)
+
+	if !ok {
+		return "", false
+	}
+
+	if seen[bucket] {
+		atomic.AddUint64(&stats.RelabelDropped, 1)
+		return "", false
+	}
+
+	seen[bucket] = true
+	return bucket, true
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRelabel(t *testing.T) {
+	rules, err := parseRelabelRules(strings.NewReader(`[
+		{"action": "drop", "regex": "debug\\..*"},
+		{"action": "replace", "regex": "web\\d+\\.(.*)", "replacement": "web.$1"},
+		{"action": "keep", "regex": "(web|api)\\..*"}
+	]`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(r []*RelabelRule) { relabels = r }(relabels)
+	relabels = rules
+
+	tests := []struct {
+		bucket string
+		want   string
+		keep   bool
+	}{
+		{"debug.web.requests", "", false},
+		{"web01.requests", "web.requests", true},
+		{"api.requests", "api.requests", true},
+		{"db.queries", "", false},
+		{"xweb01.requests", "", false},
+	}
+
+	for _, tt := range tests {
+		got, keep := relabel(tt.bucket)
+
+		if got != tt.want || keep != tt.keep {
+			t.Errorf("relabel(%q): got (%q, %v), want (%q, %v)",
+				tt.bucket, got, keep, tt.want, tt.keep)
+		}
+	}
+}
+
+func TestRelabelFlush(t *testing.T) {
+	rules, err := parseRelabelRules(strings.NewReader(`[
+		{"action": "drop", "regex": "debug\\..*"},
+		{"regex": "old\\.(.*)", "replacement": "new.$1"}
+	]`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(r []*RelabelRule) { relabels = r }(relabels)
+	relabels = rules
+
+	resetMetrics()
+	counters.m["old.requests"] = 1
+	counters.m["debug.requests"] = 2
+	timers.m["debug.latency"] = Timers{1}
+
+	var buf bytes.Buffer
+	n := flushCounters(&buf, 100) + flushTimers(&buf, 100)
+
+	if want := "new.requests 1 100\n"; buf.String() != want {
+		t.Errorf("flush: got %q, want %q", buf.String(), want)
+	}
+
+	if n != 1 {
+		t.Errorf("flush: got n=%d, want 1", n)
+	}
+
+	// Dropped buckets are still cleared
+	if len(counters.m) != 0 || len(timers.m) != 0 {
+		t.Errorf("flush: dropped buckets not cleared: %v %v", counters.m, timers.m)
+	}
+}
+
+func TestRelabelInvalidReplacement(t *testing.T) {
+	rules, err := parseRelabelRules(strings.NewReader(`[
+		{"regex": "host\\.(.*)", "replacement": "host $1"}
+	]`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(r []*RelabelRule) { relabels = r }(relabels)
+	defer func(v bool) { *sanitize = v }(*sanitize)
+	relabels = rules
+
+	*sanitize = false
+	before := atomic.LoadUint64(&stats.RelabelDropped)
+
+	if got, ok := relabel("host.cpu"); ok {
+		t.Errorf("relabel: got %q, want dropped", got)
+	}
+
+	if got := atomic.LoadUint64(&stats.RelabelDropped) - before; got != 1 {
+		t.Errorf("RelabelDropped: got %d, want 1", got)
+	}
+
+	*sanitize = true
+
+	if got, ok := relabel("host.cpu"); !ok || got != "host_cpu" {
+		t.Errorf("relabel: got (%q, %v), want (\"host_cpu\", true)", got, ok)
+	}
+}
+
+func TestRelabelCollisions(t *testing.T) {
+	rules, err := parseRelabelRules(strings.NewReader(`[
+		{"regex": "web\\d+\\.(.*)", "replacement": "web.$1"}
+	]`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(r []*RelabelRule) { relabels = r }(relabels)
+	relabels = rules
+
+	resetMetrics()
+	counters.m["web01.requests"] = 1
+	counters.m["web02.requests"] = 2
+	counters.rates["web01.requests"] = 0.5
+	counters.rates["web02.requests"] = 0.1
+	gauges.m["web01.load"] = 3
+	gauges.m["web02.load"] = 4
+	timers.m["web01.latency"] = Timers{5}
+	timers.m["web02.latency"] = Timers{6}
+	before := atomic.LoadUint64(&stats.RelabelDropped)
+
+	var buf bytes.Buffer
+	n := flushCounters(&buf, 100) + flushGauges(&buf, 100)
+
+	// Counters are summed, and only the first gauge is kept
+	want := "web.requests 3 100\n" +
+		"web.requests.sample_rate 0.1 100\n" +
+		"web.load 3 100\n"
+
+	if buf.String() != want {
+		t.Errorf("flush: got %q, want %q", buf.String(), want)
+	}
+
+	if n != 3 {
+		t.Errorf("flush: got n=%d, want 3", n)
+	}
+
+	buf.Reset()
+	flushTimers(&buf, 100)
+
+	if got := strings.Count(buf.String(), "web.latency.count "); got != 1 {
+		t.Errorf("flushTimers: got %d web.latency timers, want 1:\n%s", got, buf.String())
+	}
+
+	if got := atomic.LoadUint64(&stats.RelabelDropped) - before; got != 2 {
+		t.Errorf("RelabelDropped: got %d, want 2", got)
+	}
+}
+
+func TestParseRelabelRulesInvalid(t *testing.T) {
+	for _, input := range []string{
+		`[{"action": "rename"}]`,
+		`[{"regex": "("}]`,
+		`{}`,
+	} {
+		if _, err := parseRelabelRules(strings.NewReader(input)); err == nil {
+			t.Errorf("parseRelabelRules(%s): expected error", input)
+		}
+	}
+}
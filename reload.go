@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// reloaded holds the values of the runtime settings currently applied,
+// keyed by flag name. They differ from the flag variables after a reload.
+var reloaded atomic.Value
+
+// reloadedFlags returns the runtime settings currently applied, or nil
+// before the first are applied
+func reloadedFlags() map[string]string {
+	m, _ := reloaded.Load().(map[string]string)
+	return m
+}
+
+// reloadConfig re-reads the -config file and applies the settings that can
+// change at runtime. Other settings from the file take effect on restart.
+// The file is read into a separate FlagSet, since the running daemon reads
+// the flag variables without locking.
+func reloadConfig() error {
+	pcts, rules := *percentiles, *renameRules
+
+	if *configFile != "" {
+		fs := reloadFlagSet()
+
+		if err := loadConfigFile(fs, *configFile, cmdlineFlags); err != nil {
+			return err
+		}
+
+		pcts = fs.Lookup("percentiles").Value.String()
+		rules = fs.Lookup("rename-rules").Value.String()
+	}
+
+	return applyRuntimeConfig(pcts, rules)
+}
+
+// reloadFlagSet returns a FlagSet accepting every flag as a string. Flags
+// left out of the config file get their default, except those set on the
+// command line, which keep their value.
+func reloadFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		value := f.DefValue
+
+		if cmdlineFlags[f.Name] {
+			value = f.Value.String()
+		}
+
+		fs.String(f.Name, value, f.Usage)
+	})
+
+	return fs
+}
+
+// applyRuntimeConfig parses the percentiles and rename rules and swaps them
+// in. Nothing is swapped unless both load, so a bad edit leaves the running
+// configuration untouched.
+func applyRuntimeConfig(percentiles, renameRules string) error {
+	pcts, err := parsePercentiles(percentiles)
+
+	if err != nil {
+		return fmt.Errorf("invalid -percentiles: %v", err)
+	}
+
+	var rules *RenameRules
+
+	if renameRules != "" {
+		rules, err = loadRenameRules(renameRules)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	setPercentiles(pcts)
+	renames.Store(rules)
+	reloaded.Store(map[string]string{
+		"percentiles":  percentiles,
+		"rename-rules": renameRules,
+	})
+
+	return nil
+}
+
+// watchReload reloads the configuration each time the process receives
+// SIGHUP. The returned func stops watching and waits for a reload in
+// progress to finish.
+func watchReload() func() {
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		defer close(done)
+
+		for range sig {
+			if err := reloadConfig(); err != nil {
+				logError("Unable to reload configuration", "error", err)
+				continue
+			}
+
+			logInfo("Reloaded configuration")
+		}
+	}()
+
+	return func() {
+		// No signal is delivered to sig once Stop returns
+		signal.Stop(sig)
+		close(sig)
+		<-done
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	defer func(p, r string) {
+		*percentiles = p
+		*renameRules = r
+	}(*percentiles, *renameRules)
+
+	defer setPercentiles(Percentiles())
+	defer renames.Store(currentRenames())
+	defer reloaded.Store(reloadedFlags())
+
+	path := filepath.Join(dir, "rules")
+	ioutil.WriteFile(path, []byte("srv1=service.one\n"), 0600)
+	*renameRules = path
+	*percentiles = "95"
+
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := currentRenames().Rename("srv1"); got != "service.one" {
+		t.Fatalf("Rename(srv1) before reload: got %q, want service.one", got)
+	}
+
+	// The flags are set before the watcher starts so it never reads them
+	// while they change
+	ioutil.WriteFile(path, []byte("srv1=service.two\n"), 0600)
+	*percentiles = "50,99"
+	stop := watchReload()
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for currentRenames().Rename("srv1") != "service.two" {
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatal("SIGHUP: timed out waiting for rename rules to reload")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop()
+
+	if got, want := Percentiles(), []float64{50, 99}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Percentiles after reload: got %v, want %v", got, want)
+	}
+
+	// A broken file keeps the rules already loaded
+	ioutil.WriteFile(path, []byte("broken\n"), 0600)
+
+	if err := reloadConfig(); err == nil {
+		t.Error("reloadConfig with invalid rules: expected error")
+	}
+
+	if got := currentRenames().Rename("srv1"); got != "service.two" {
+		t.Errorf("Rename(srv1) after failed reload: got %q, want service.two", got)
+	}
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	defer func(c, p string, n int, set map[string]bool) {
+		*configFile, *percentiles, *maxLineLength, cmdlineFlags = c, p, n, set
+	}(*configFile, *percentiles, *maxLineLength, cmdlineFlags)
+
+	defer setPercentiles(Percentiles())
+	defer renames.Store(currentRenames())
+	defer reloaded.Store(reloadedFlags())
+
+	path := filepath.Join(dir, "statsdaemon.toml")
+	ioutil.WriteFile(path, []byte("percentiles = [50, 99]\nmax-line-length = 1024\n"), 0600)
+	*configFile = path
+	*percentiles = "95"
+	cmdlineFlags = nil
+
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := Percentiles(), []float64{50, 99}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Percentiles after reload: got %v, want %v", got, want)
+	}
+
+	// The flag variables themselves are left alone
+	if *percentiles != "95" || *maxLineLength == 1024 {
+		t.Errorf("reload changed flags: -percentiles %q, -max-line-length %d",
+			*percentiles, *maxLineLength)
+	}
+
+	// Flags set on the command line win over the file
+	cmdlineFlags = map[string]bool{"percentiles": true}
+
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := Percentiles(), []float64{95}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Percentiles with -percentiles on the command line: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// RenameRules rewrites bucket names on ingest. Rules are read from a file of
+// pattern=replacement lines. A pattern ending in * matches any bucket with
+// that prefix, and the matched prefix is swapped for the replacement (minus
+// its own trailing *). Exact matches take precedence over prefix matches,
+// and the longest matching prefix wins.
+//
+//	# exact match
+//	srv1=service.api.srv1
+//	# prefix match
+//	legacy.*=service.legacy.*
+type RenameRules struct {
+	exact    map[string]string
+	prefixes []renamePrefix
+}
+
+type renamePrefix struct {
+	prefix      string
+	replacement string
+}
+
+// renames holds the *RenameRules loaded from -rename-rules, if any. It is
+// swapped atomically when the configuration is reloaded.
+var renames atomic.Value
+
+// currentRenames returns the rename rules in effect, or nil if there are none
+func currentRenames() *RenameRules {
+	r, _ := renames.Load().(*RenameRules)
+	return r
+}
+
+// loadRenameRules reads rename rules from a file
+func loadRenameRules(path string) (*RenameRules, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return parseRenameRules(f)
+}
+
+// parseRenameRules parses pattern=replacement lines. Blank lines and lines
+// starting with # are ignored.
+func parseRenameRules(r io.Reader) (*RenameRules, error) {
+	rules := &RenameRules{exact: make(map[string]string)}
+	s := bufio.NewScanner(r)
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+
+		if i < 1 || i == len(line)-1 {
+			return nil, fmt.Errorf("invalid rename rule on line %d: %q", n, line)
+		}
+
+		pattern := strings.TrimSpace(line[:i])
+		replacement := strings.TrimSpace(line[i+1:])
+		prefix := strings.HasSuffix(pattern, "*")
+
+		if prefix {
+			replacement = strings.TrimSuffix(replacement, "*")
+		}
+
+		// Renamed buckets aren't validated again on ingest
+		for j := 0; j < len(replacement); j++ {
+			if !validBucketChar(replacement[j]) {
+				return nil, fmt.Errorf("invalid rename rule on line %d: invalid character %q in %q",
+					n, replacement[j], replacement)
+			}
+		}
+
+		if prefix {
+			rules.prefixes = append(rules.prefixes, renamePrefix{
+				prefix:      strings.TrimSuffix(pattern, "*"),
+				replacement: replacement,
+			})
+		} else {
+			rules.exact[pattern] = replacement
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// Rename returns the new name for a bucket, or the bucket unchanged if no
+// rule matches
+func (r *RenameRules) Rename(bucket string) string {
+	if r == nil {
+		return bucket
+	}
+
+	if name, ok := r.exact[bucket]; ok {
+		return name
+	}
+
+	var match *renamePrefix
+
+	for i, p := range r.prefixes {
+		if strings.HasPrefix(bucket, p.prefix) &&
+			(match == nil || len(p.prefix) > len(match.prefix)) {
+			match = &r.prefixes[i]
+		}
+	}
+
+	if match == nil {
+		return bucket
+	}
+
+	return match.replacement + bucket[len(match.prefix):]
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testRenameRules = `
+# legacy short names
+srv1=service.api.srv1
+
+legacy.*=service.legacy.*
+legacy.db.*=service.db.*
+`
+
+func TestRenameRules(t *testing.T) {
+	rules, err := parseRenameRules(strings.NewReader(testRenameRules))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		bucket string
+		want   string
+	}{
+		{"srv1", "service.api.srv1"},
+		{"srv10", "srv10"},
+		{"legacy.requests", "service.legacy.requests"},
+		{"legacy.db.queries", "service.db.queries"},
+		{"other.requests", "other.requests"},
+	}
+
+	for _, tt := range tests {
+		if got := rules.Rename(tt.bucket); got != tt.want {
+			t.Errorf("Rename(%q): got %q, want %q", tt.bucket, got, tt.want)
+		}
+	}
+}
+
+func TestParseMetricRename(t *testing.T) {
+	rules, err := parseRenameRules(strings.NewReader(testRenameRules))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer renames.Store(currentRenames())
+	renames.Store(rules)
+
+	for input, want := range map[string]string{
+		"srv1:1|c":     "service.api.srv1",
+		"srv2:1|c":     "srv2",
+		"legacy.x:1|g": "service.legacy.x",
+	} {
+		m, err := parseMetric([]byte(input))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Bucket != want {
+			t.Errorf("parseMetric(%q): got bucket %q, want %q",
+				input, m.Bucket, want)
+		}
+	}
+}
+
+func TestParseRenameRulesInvalid(t *testing.T) {
+	for _, input := range []string{
+		"srv1",
+		"=foo",
+		"srv1=",
+		"srv1=service api",
+		"srv1=service.api*",
+		"legacy.*=service/legacy.*",
+	} {
+		if _, err := parseRenameRules(strings.NewReader(input)); err == nil {
+			t.Errorf("parseRenameRules(%q): expected error", input)
+		}
+	}
+}
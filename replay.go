@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"time"
+)
+
+// runReplay replays a capture of newline separated metrics (see
+// -replay-file), flushing every -flush-interval as the listeners would, then
+// flushes once more and waits for any background sends. A line may start
+// with the Unix time it was captured at, e.g. "1700000000.25 foo:1|c", and
+// the gaps between those times are reproduced unless -replay-rate sets a
+// fixed number of lines per second. With -replay-loop the capture is
+// replayed until the process is stopped.
+func runReplay(r io.ReadSeeker) error {
+	tick := time.NewTicker(*flushInterval)
+	defer tick.Stop()
+
+	// wait sleeps for d, flushing if a flush falls due in the meantime
+	wait := func(d time.Duration) {
+		deadline := time.Now().Add(d)
+
+		for left := d; left > 0; left = time.Until(deadline) {
+			select {
+			case <-tick.C:
+				flushMetrics(flushSections)
+			case <-time.After(left):
+			}
+		}
+	}
+
+	for {
+		br := newLineReader(r)
+		var last float64
+
+		for {
+			line, tooLong, err := readLine(br)
+
+			if tooLong {
+				countInvalid(nil)
+			} else if len(line) > 0 {
+				ts, msg := splitReplayLine(line)
+
+				switch {
+				case *replayRate > 0:
+					wait(time.Duration(float64(time.Second) / *replayRate))
+				case ts > 0 && last > 0 && ts > last:
+					wait(time.Duration((ts - last) * float64(time.Second)))
+				}
+
+				if ts > 0 {
+					last = ts
+				}
+
+				parseMessage(msg, nil, "", processMetric)
+			}
+
+			select {
+			case <-tick.C:
+				flushMetrics(flushSections)
+			default:
+			}
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if !*replayLoop {
+			break
+		}
+
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	flushMetrics(flushSections)
+	asyncSends.Wait()
+	return nil
+}
+
+// splitReplayLine splits the capture time from the start of a replayed line.
+// Lines without one are returned whole with a time of 0.
+func splitReplayLine(line []byte) (float64, []byte) {
+	i := bytes.IndexByte(line, ' ')
+
+	if i < 1 {
+		return 0, line
+	}
+
+	ts, err := strconv.ParseFloat(string(line[:i]), 64)
+
+	if err != nil || ts <= 0 {
+		return 0, line
+	}
+
+	return ts, line[i+1:]
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunReplay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	received := make(chan string)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			received <- string(b)
+		}
+	}()
+
+	defer func(addr string, b bool, rate float64) {
+		*graphite = addr
+		*noInternalStats = b
+		*replayRate = rate
+	}(*graphite, *noInternalStats, *replayRate)
+
+	*graphite = l.Addr().String()
+	*noInternalStats = true
+
+	tests := []struct {
+		input string
+		rate  float64
+		min   time.Duration
+		max   time.Duration
+	}{
+		// The capture times are 100ms apart in all
+		{"1700000000.00 hits:1|c\n1700000000.05 hits:2|c\nlevel:4|g\n1700000000.10 hits:3|c",
+			0, 100 * time.Millisecond, 5 * time.Second},
+		// A fixed rate ignores capture times an hour apart
+		{"1700000000 hits:1|c\n1700003600 hits:2|c\nlevel:4|g\n1700007200 hits:3|c",
+			1000, 0, 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		*replayRate = tt.rate
+		resetMetrics()
+		start := time.Now()
+
+		go func() {
+			if err := runReplay(strings.NewReader(tt.input)); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		select {
+		case got := <-received:
+			for _, want := range []string{"hits 6 ", "level 4 "} {
+				if !strings.Contains(got, want) {
+					t.Errorf("runReplay (rate %v): %q not found in %q", tt.rate, want, got)
+				}
+			}
+		case <-time.After(tt.max):
+			t.Fatalf("runReplay (rate %v): timed out waiting for flush", tt.rate)
+		}
+
+		if elapsed := time.Since(start); elapsed < tt.min {
+			t.Errorf("runReplay (rate %v): took %v, want at least %v", tt.rate, elapsed, tt.min)
+		}
+	}
+}
+
+func TestSplitReplayLine(t *testing.T) {
+	tests := []struct {
+		line string
+		ts   float64
+		msg  string
+	}{
+		{"1700000000.5 foo:1|c", 1700000000.5, "foo:1|c"},
+		{"foo:1|c", 0, "foo:1|c"},
+		{"foo:1|c bar:2|c", 0, "foo:1|c bar:2|c"},
+		{" foo:1|c", 0, " foo:1|c"},
+	}
+
+	for _, tt := range tests {
+		ts, msg := splitReplayLine([]byte(tt.line))
+
+		if ts != tt.ts || string(msg) != tt.msg {
+			t.Errorf("splitReplayLine(%q): got %v %q, want %v %q", tt.line, ts, msg, tt.ts, tt.msg)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RollupRule aggregates the counters and timers whose names match a regex
+// into an extra bucket named by a template. The regex is anchored at both
+// ends and the template may refer to its capture groups ($1 etc.). Rules are
+// read from a file of regex=>template lines, e.g.
+//
+//	# sum requests over all web hosts
+//	web\d+\.(.*)=>web.$1
+//
+// The matching buckets still flush under their own names.
+type RollupRule struct {
+	re       *regexp.Regexp
+	template string
+}
+
+// rollups holds the rules loaded from -rollup-rules, if any
+var rollups []*RollupRule
+
+// templateRef matches the capture group references in a rollup template
+var templateRef = regexp.MustCompile(`\$(\w+|\{\w+\})`)
+
+// loadRollupRules reads rollup rules from a file
+func loadRollupRules(path string) ([]*RollupRule, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return parseRollupRules(f)
+}
+
+// parseRollupRules parses regex=>template lines. Blank lines and lines
+// starting with # are ignored.
+func parseRollupRules(r io.Reader) ([]*RollupRule, error) {
+	var rules []*RollupRule
+	s := bufio.NewScanner(r)
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=>")
+
+		if i < 1 || i == len(line)-2 {
+			return nil, fmt.Errorf("invalid rollup rule on line %d: %q", n, line)
+		}
+
+		re, err := regexp.Compile("^(?:" + strings.TrimSpace(line[:i]) + ")$")
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollup rule on line %d: %s", n, err)
+		}
+
+		template := strings.TrimSpace(line[i+2:])
+
+		// Capture groups are bucket names, so only the literal part of the
+		// template can make a target invalid
+		literal := templateRef.ReplaceAllString(template, "")
+
+		for j := 0; j < len(literal); j++ {
+			if !validBucketChar(literal[j]) {
+				return nil, fmt.Errorf("invalid rollup rule on line %d: invalid character %q in template %q",
+					n, literal[j], template)
+			}
+		}
+
+		rules = append(rules, &RollupRule{
+			re:       re,
+			template: template,
+		})
+	}
+
+	return rules, s.Err()
+}
+
+// rollupTargets returns the rollup buckets a bucket contributes to. A bucket
+// never rolls up into itself, a bucket matched by several rules with the
+// same result counts once, and a template that expands to an empty name is
+// skipped.
+func rollupTargets(bucket string) []string {
+	var targets []string
+
+	for _, rule := range rollups {
+		match := rule.re.FindStringSubmatchIndex(bucket)
+
+		if match == nil {
+			continue
+		}
+
+		target, err := checkBucket(rule.re.ExpandString(nil, rule.template, bucket, match))
+
+		if err != nil || target == bucket || containsString(targets, target) {
+			continue
+		}
+
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// containsString reports whether s is in list
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rollupKeys returns the buckets of a metric map that match a rollup rule,
+// mapped to their targets. The keys are taken before any rollup bucket is
+// added so rollups aren't rolled up again.
+func rollupKeys(m interface{}) map[string][]string {
+	keys := make(map[string][]string)
+
+	for _, k := range sortedKeys(m) {
+		if targets := rollupTargets(k); len(targets) > 0 {
+			keys[k] = targets
+		}
+	}
+
+	return keys
+}
+
+// rollupCounters adds the sum of each rollup's matching counters to the
+// rollup bucket so it flushes alongside them. New rollup buckets count
+// towards -max-buckets.
+func rollupCounters() {
+	if len(rollups) == 0 {
+		return
+	}
+
+	counters.Lock()
+	defer counters.Unlock()
+
+	for k, targets := range rollupKeys(counters.m) {
+		for _, target := range targets {
+			if _, ok := counters.m[target]; overBucketLimit(len(counters.m), ok) {
+				continue
+			}
+
+			counters.m[target] += counters.m[k]
+
+			if *emitRawCounts {
+				counters.raw[target] += counters.raw[k]
+			}
+		}
+	}
+}
+
+// rollupTimers merges the values of each rollup's matching timers into the
+// rollup bucket so its percentiles cover all of them. New rollup buckets
+// count towards -max-buckets, and the merged values are kept to
+// -timer-reservoir-size like any other timer's.
+func rollupTimers() {
+	if len(rollups) == 0 {
+		return
+	}
+
+	timers.Lock()
+	defer timers.Unlock()
+	keys := rollupKeys(timers.m)
+	sources := make([]string, 0, len(keys))
+
+	for k := range keys {
+		sources = append(sources, k)
+	}
+
+	// Merge in sorted order so exact timer values are in a stable order
+	sort.Strings(sources)
+
+	for _, k := range sources {
+		for _, target := range keys[k] {
+			_, ok := timers.m[target]
+
+			if overBucketLimit(len(timers.m), ok) {
+				continue
+			}
+
+			if !ok {
+				timers.m[target] = nil
+			}
+
+			for _, v := range timers.m[k] {
+				addTimerValue(target, v)
+			}
+
+			timers.dropped[target] += timers.dropped[k]
+			timers.sampled[target] += timers.sampled[k]
+
+			if d := timers.digests[k]; d != nil {
+				if timers.digests[target] == nil {
+					timers.digests[target] = NewTDigest(defaultCompression)
+				}
+
+				timers.digests[target].Merge(d)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRollupFlush(t *testing.T) {
+	rules, err := parseRollupRules(strings.NewReader(`
+		# sum over the web hosts
+		web\d+\.(.*)=>web.$1
+	`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(r []*RollupRule) { rollups = r }(rollups)
+	rollups = rules
+
+	resetMetrics()
+	defer resetMetrics()
+
+	processMetric(&Metric{Bucket: "web01.requests", CountValue: 3, Type: Counter})
+	processMetric(&Metric{Bucket: "web02.requests", CountValue: 4, Type: Counter})
+	processMetric(&Metric{Bucket: "db01.requests", CountValue: 5, Type: Counter})
+
+	buf := getBuffer()
+	defer bufferPool.Put(buf)
+
+	for _, b := range writeSections(100, []string{"counters"}) {
+		b.WriteTo(buf)
+		bufferPool.Put(b)
+	}
+
+	want := "db01.requests 5 100\n" +
+		"web.requests 7 100\n" +
+		"web01.requests 3 100\n" +
+		"web02.requests 4 100\n"
+
+	if buf.String() != want {
+		t.Errorf("flush: got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestRollupTimers(t *testing.T) {
+	rules, err := parseRollupRules(strings.NewReader(`web\d+\.(.*)=>web.$1`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(r []*RollupRule) { rollups = r }(rollups)
+	rollups = rules
+
+	resetMetrics()
+	defer resetMetrics()
+
+	timers.m["web01.latency"] = Timers{1, 2}
+	timers.m["web02.latency"] = Timers{3}
+	rollupTimers()
+
+	var buf bytes.Buffer
+	flushTimers(&buf, 100)
+
+	for _, line := range []string{
+		"web.latency.count 3 100\n",
+		"web.latency.upper 3.000000 100\n",
+		"web01.latency.count 2 100\n",
+		"web02.latency.count 1 100\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("flush: missing %q in %q", line, buf.String())
+		}
+	}
+}
+
+func TestRollupLimits(t *testing.T) {
+	rules, err := parseRollupRules(strings.NewReader(`
+		web\d+\.(.*)=>web.$1
+		api(\d*)\.(.*)=>$1
+	`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(r []*RollupRule) { rollups = r }(rollups)
+	defer func(n int) { *maxBuckets = n }(*maxBuckets)
+	defer func(n int) { *timerReservoirSize = n }(*timerReservoirSize)
+	rollups = rules
+
+	resetMetrics()
+	defer resetMetrics()
+
+	// A template that expands to an empty name is skipped
+	if got := rollupTargets("api.requests"); len(got) != 0 {
+		t.Errorf("rollupTargets: got %q, want none", got)
+	}
+
+	// Rollup buckets are kept to -timer-reservoir-size, but still count
+	// every value
+	*timerReservoirSize = 2
+	timers.m["web01.latency"] = Timers{1, 2}
+	timers.m["web02.latency"] = Timers{3, 4}
+	timers.dropped["web02.latency"] = 1
+	rollupTimers()
+
+	if got := len(timers.m["web.latency"]); got != 2 {
+		t.Errorf("rollup timer: got %d values, want 2", got)
+	}
+
+	if got := len(timers.m["web.latency"]) + int(timers.dropped["web.latency"]); got != 5 {
+		t.Errorf("rollup timer: got count %d, want 5", got)
+	}
+
+	// New rollup buckets count towards -max-buckets
+	*maxBuckets = 2
+	counters.m["web01.requests"] = 1
+	counters.m["web02.requests"] = 2
+	before := atomic.LoadUint64(&stats.CardinalityDropped)
+	rollupCounters()
+
+	if _, ok := counters.m["web.requests"]; ok || len(counters.m) != 2 {
+		t.Errorf("rollup counter: got %v, want no rollup bucket", counters.m)
+	}
+
+	if got := atomic.LoadUint64(&stats.CardinalityDropped) - before; got != 2 {
+		t.Errorf("CardinalityDropped: got %d, want 2", got)
+	}
+}
+
+func TestParseRollupRulesInvalid(t *testing.T) {
+	for _, input := range []string{
+		"web.*",
+		"=>web",
+		"web.*=>",
+		"(=>web",
+		"web(.*)=>web/$1",
+		"web(.*)=>web $1",
+		"web(.*)=>web.$$1",
+	} {
+		if _, err := parseRollupRules(strings.NewReader(input)); err == nil {
+			t.Errorf("parseRollupRules(%q): expected error", input)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sendQueue holds flushes that couldn't be sent to the backend so they can
+// be resent, oldest first, once it recovers. Flushes beyond -max-queue-bytes
+// are spilled to files in -spill-dir, so the files always hold older
+// flushes than memory.
+type sendQueue struct {
+	sync.Mutex
+	mem       [][]byte
+	memBytes  int64
+	files     []spillFile
+	fileBytes int64
+	lastSeq   int64
+}
+
+// spillFile is a flush spilled to disk
+type spillFile struct {
+	path string
+	size int64
+}
+
+// graphiteQueue holds the flushes waiting to be resent to Graphite
+var graphiteQueue = &sendQueue{}
+
+// queueGraphite reports whether flushes that fail to reach Graphite are
+// queued for resending instead of dropped
+func queueGraphite() bool {
+	return *maxQueueBytes > 0 || *spillDir != ""
+}
+
+// send resends the queued flushes and then b, oldest first. At most
+// -max-resend-bytes of queued flushes are resent each time, since this runs
+// on the flush path. If any of them fails, or some are left for the next
+// flush, b is queued behind the rest.
+func (q *sendQueue) send(b []byte, send func([]byte) error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.drain(send, *maxResendBytes) && send(b) == nil {
+		return
+	}
+
+	q.push(append([]byte(nil), b...))
+}
+
+// drain resends the queued flushes oldest first, stopping at the first one
+// that fails or once limit bytes have been resent (0 for no limit). The
+// oldest flush is always tried, so a flush larger than limit still goes
+// out. It reports whether the queue is now empty. Must be called with q
+// locked.
+func (q *sendQueue) drain(send func([]byte) error, limit int64) bool {
+	var sent int64
+
+	for len(q.files) > 0 {
+		if limit > 0 && sent >= limit {
+			return false
+		}
+
+		f := q.files[0]
+		b, err := ioutil.ReadFile(f.path)
+
+		if err != nil {
+			logError("Unable to read spilled flush", "path", f.path, "error", err)
+		} else if send(b) != nil {
+			return false
+		}
+
+		sent += f.size
+		q.removeOldestFile()
+	}
+
+	for len(q.mem) > 0 {
+		if limit > 0 && sent >= limit {
+			return false
+		}
+
+		if send(q.mem[0]) != nil {
+			return false
+		}
+
+		sent += int64(len(q.mem[0]))
+		q.memBytes -= int64(len(q.mem[0]))
+		q.mem[0] = nil
+		q.mem = q.mem[1:]
+	}
+
+	return true
+}
+
+// push adds a flush to the back of the queue. Once memory holds more than
+// -max-queue-bytes, the oldest flushes are spilled to -spill-dir, or
+// dropped without one. Must be called with q locked.
+func (q *sendQueue) push(b []byte) {
+	q.mem = append(q.mem, b)
+	q.memBytes += int64(len(b))
+
+	for q.memBytes > *maxQueueBytes && len(q.mem) > 0 {
+		old := q.mem[0]
+		q.memBytes -= int64(len(old))
+		q.mem[0] = nil
+		q.mem = q.mem[1:]
+
+		if *spillDir == "" {
+			logWarn("Dropping queued flush", "bytes", len(old))
+			continue
+		}
+
+		if err := q.spill(old); err != nil {
+			logError("Unable to spill flush", "dir", *spillDir, "bytes", len(old),
+				"error", err)
+		}
+	}
+}
+
+// spill writes a flush to a new file in -spill-dir, dropping the oldest
+// spilled flushes to stay within -max-spill-bytes. The file is written to a
+// temporary name first so a crash never leaves a partial flush. Must be
+// called with q locked.
+func (q *sendQueue) spill(b []byte) error {
+	size := int64(len(b))
+
+	if size > *maxSpillBytes {
+		return fmt.Errorf("flush of %d bytes exceeds -max-spill-bytes", size)
+	}
+
+	for len(q.files) > 0 && q.fileBytes+size > *maxSpillBytes {
+		logWarn("Dropping spilled flush", "path", q.files[0].path,
+			"bytes", q.files[0].size)
+		q.removeOldestFile()
+	}
+
+	f, err := ioutil.TempFile(*spillDir, ".spill")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// Names sort in the order the flushes were spilled, across restarts too
+	seq := time.Now().UnixNano()
+
+	if seq <= q.lastSeq {
+		seq = q.lastSeq + 1
+	}
+
+	q.lastSeq = seq
+	path := filepath.Join(*spillDir, fmt.Sprintf("%020d.spill", seq))
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	q.files = append(q.files, spillFile{path, size})
+	q.fileBytes += size
+	return nil
+}
+
+// removeOldestFile deletes the oldest spilled flush. Must be called with q
+// locked.
+func (q *sendQueue) removeOldestFile() {
+	f := q.files[0]
+
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		logError("Unable to remove spilled flush", "path", f.path, "error", err)
+	}
+
+	q.fileBytes -= f.size
+	q.files = q.files[1:]
+}
+
+// loadSpill queues the flushes left in -spill-dir by an earlier run, so
+// they are resent once Graphite is reachable
+func (q *sendQueue) loadSpill(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.spill"))
+
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(paths)
+	q.Lock()
+	defer q.Unlock()
+
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+
+		if err != nil {
+			return err
+		}
+
+		q.files = append(q.files, spillFile{path, fi.Size()})
+		q.fileBytes += fi.Size()
+	}
+
+	for len(q.files) > 0 && q.fileBytes > *maxSpillBytes {
+		q.removeOldestFile()
+	}
+
+	if len(q.files) > 0 {
+		logInfo("Loaded spilled flushes", "dir", dir, "files", len(q.files),
+			"bytes", q.fileBytes)
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeGraphite records the flushes sent to it while it is up
+type fakeGraphite struct {
+	down bool
+	got  []string
+}
+
+func (g *fakeGraphite) send(b []byte) error {
+	if g.down {
+		return errors.New("connection refused")
+	}
+
+	g.got = append(g.got, string(b))
+	return nil
+}
+
+func TestSpillOutage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	defer func(s string, q, m int64) {
+		*spillDir, *maxQueueBytes, *maxSpillBytes = s, q, m
+	}(*spillDir, *maxQueueBytes, *maxSpillBytes)
+	*spillDir, *maxQueueBytes, *maxSpillBytes = dir, 40, 1<<20
+
+	q := &sendQueue{}
+	g := &fakeGraphite{down: true}
+	var want []string
+
+	// A long outage: every flush fails and the older ones go to disk
+	for i := 0; i < 10; i++ {
+		b := fmt.Sprintf("flush.%d 1 %d\n", i, 100+i)
+		want = append(want, b)
+		q.send([]byte(b), g.send)
+	}
+
+	if q.memBytes > *maxQueueBytes {
+		t.Errorf("outage: %d bytes in memory, want at most %d", q.memBytes, *maxQueueBytes)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.spill"))
+
+	if len(files) != 8 || len(q.mem) != 2 {
+		t.Fatalf("outage: got %d spilled and %d in memory, want 8 and 2", len(files), len(q.mem))
+	}
+
+	// A restart picks up the spilled flushes
+	restarted := &sendQueue{}
+
+	if err := restarted.loadSpill(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(restarted.files) != 8 || restarted.fileBytes != q.fileBytes {
+		t.Errorf("loadSpill: got %d files of %d bytes, want 8 of %d",
+			len(restarted.files), restarted.fileBytes, q.fileBytes)
+	}
+
+	// Recovery resends everything oldest first, then the new flush
+	g.down = false
+	b := "flush.10 1 110\n"
+	want = append(want, b)
+	q.send([]byte(b), g.send)
+
+	if strings.Join(g.got, "") != strings.Join(want, "") {
+		t.Errorf("recovery: got %q, want %q", g.got, want)
+	}
+
+	files, _ = filepath.Glob(filepath.Join(dir, "*"))
+
+	if len(files) != 0 || len(q.mem) != 0 || q.memBytes != 0 || q.fileBytes != 0 {
+		t.Errorf("recovery: queue not empty: files %v, %d in memory", files, len(q.mem))
+	}
+}
+
+func TestSpillLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	defer func(s string, q, m int64) {
+		*spillDir, *maxQueueBytes, *maxSpillBytes = s, q, m
+	}(*spillDir, *maxQueueBytes, *maxSpillBytes)
+	*spillDir, *maxQueueBytes, *maxSpillBytes = dir, 0, 30
+
+	q := &sendQueue{}
+	g := &fakeGraphite{down: true}
+
+	for i := 0; i < 5; i++ {
+		q.send([]byte(fmt.Sprintf("flush.%d 1 1\n", i)), g.send)
+	}
+
+	// Only the newest flushes fit within -max-spill-bytes
+	g.down = false
+	q.drain(g.send, 0)
+
+	if want := "flush.3 1 1\nflush.4 1 1\n"; strings.Join(g.got, "") != want {
+		t.Errorf("drain: got %q, want %q", g.got, want)
+	}
+}
+
+func TestQueueWithoutSpill(t *testing.T) {
+	defer func(s string, q int64) { *spillDir, *maxQueueBytes = s, q }(*spillDir, *maxQueueBytes)
+	*spillDir, *maxQueueBytes = "", 24
+
+	q := &sendQueue{}
+	g := &fakeGraphite{down: true}
+
+	for i := 0; i < 3; i++ {
+		q.send([]byte(fmt.Sprintf("flush.%d 1 1\n", i)), g.send)
+	}
+
+	// The oldest flush is dropped to stay within -max-queue-bytes
+	g.down = false
+	q.drain(g.send, 0)
+
+	if want := "flush.1 1 1\nflush.2 1 1\n"; strings.Join(g.got, "") != want {
+		t.Errorf("drain: got %q, want %q", g.got, want)
+	}
+}
+
+func TestQueueResendLimit(t *testing.T) {
+	defer func(s string, q, r int64) {
+		*spillDir, *maxQueueBytes, *maxResendBytes = s, q, r
+	}(*spillDir, *maxQueueBytes, *maxResendBytes)
+	*spillDir, *maxQueueBytes, *maxResendBytes = "", 1<<20, 24
+
+	q := &sendQueue{}
+	g := &fakeGraphite{down: true}
+	var want []string
+
+	for i := 0; i < 5; i++ {
+		b := fmt.Sprintf("flush.%d 1 1\n", i)
+		want = append(want, b)
+		q.send([]byte(b), g.send)
+	}
+
+	// Each flush resends two queued flushes and queues itself behind the
+	// rest until the backlog is gone
+	g.down = false
+
+	for i, sent := range []int{2, 4, 6, 9} {
+		b := fmt.Sprintf("flush.%d 1 1\n", 5+i)
+		want = append(want, b)
+		q.send([]byte(b), g.send)
+
+		if len(g.got) != sent {
+			t.Errorf("flush %d: got %d flushes sent, want %d", 5+i, len(g.got), sent)
+		}
+	}
+
+	if strings.Join(g.got, "") != strings.Join(want, "") {
+		t.Errorf("recovery: got %q, want %q", g.got, want)
+	}
+
+	if len(q.mem) != 0 || q.memBytes != 0 {
+		t.Errorf("recovery: %d flushes still queued", len(q.mem))
+	}
+}
@@ -4,17 +4,24 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"math"
+	"math/rand"
 	"net"
+	"os"
+	"os/signal"
 	//"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	//"github.com/davecgh/go-spew/spew"
@@ -30,20 +37,253 @@ const BufSize = 8192
 const Counter = "c"
 const Gauge = "g"
 const Timer = "ms"
+const Distribution = "d"
 
 //-----------------------------------------------------------------------------
 
 // Command line flags
 var (
-	listen   = flag.String("listen", ":8125", "Listener address")
+	configFile = flag.String("config", "",
+		"Config file of flag settings; flags given on the command line take precedence")
+
+	listen   = flag.String("listen", ":8125", "Comma separated listener addresses")
 	graphite = flag.String("graphite", "localhost:2003", "Graphite server address")
 
+	flushInterval = flag.Duration("flush-interval", FlushInterval,
+		"Interval between flushes")
+	counterFlushInterval = flag.Duration("counter-flush-interval", 0,
+		"Interval between counter flushes (0 uses -flush-interval)")
+	gaugeFlushInterval = flag.Duration("gauge-flush-interval", 0,
+		"Interval between gauge flushes (0 uses -flush-interval)")
+	timerFlushInterval = flag.Duration("timer-flush-interval", 0,
+		"Interval between timer flushes (0 uses -flush-interval)")
+	counterWindow = flag.Duration("counter-window", 0,
+		"Flush counters as a sliding sum over this window instead of per interval (0 disables)")
+	flushJitter = flag.String("flush-jitter", "0",
+		"Maximum random delay of the first flush, as a duration or a percentage of -flush-interval")
+
+	namedListeners = flag.String("listeners", "",
+		"Comma separated name=addr listeners whose metrics are prefixed with the name")
+
+	backend = flag.String("backend", "graphite",
+		"Backend flushed metrics are sent to: graphite or kafka")
+
+	kafkaBrokers = flag.String("kafka-brokers", "localhost:9092",
+		"Comma separated Kafka broker addresses for -backend kafka")
+	kafkaTopic = flag.String("kafka-topic", "statsd",
+		"Kafka topic flushed metrics are published to")
+
+	graphiteUDP = flag.Bool("graphite-udp", false,
+		"Send metrics to Graphite as plaintext UDP datagrams instead of over TCP")
+
+	graphiteTimeout = flag.Duration("graphite-timeout", 5*time.Second,
+		"Timeout for connecting to and writing each flush to Graphite (0 disables)")
+
+	graphiteTLS           = flag.Bool("graphite-tls", false, "Connect to Graphite using TLS")
+	graphiteTLSSkipVerify = flag.Bool("graphite-tls-skip-verify", false,
+		"Skip verification of the Graphite TLS certificate (testing only)")
+	graphiteCompress = flag.Bool("graphite-compress", false,
+		"Send each flush to Graphite as a gzip stream (the relay must accept gzip)")
+	maxQueueBytes = flag.Int64("max-queue-bytes", 0,
+		"Keep flushes that fail to reach Graphite in memory, up to this many bytes, and resend them oldest first")
+	spillDir = flag.String("spill-dir", "",
+		"Directory that queued Graphite flushes beyond -max-queue-bytes are spilled to")
+	maxSpillBytes = flag.Int64("max-spill-bytes", 1<<30,
+		"Most bytes of flushes kept in -spill-dir; the oldest are dropped beyond it")
+	maxResendBytes = flag.Int64("max-resend-bytes", 16<<20,
+		"Most bytes of queued flushes resent with each flush, so a backlog doesn't hold up processing (0 for no limit)")
+	splitFlush = flag.Bool("split-flush", false,
+		"Send each flush section (counters, gauges, ...) to the backend separately")
+
+	trackPacketSize = flag.Bool("track-packet-size", false,
+		"Emit statsd.packet_size.* percentiles of received UDP datagram and TCP line sizes")
+
+	// TLS for the TCP listener
+	tlsCert = flag.String("tls-cert", "",
+		"TLS certificate file for the TCP listener (requires -tls-key)")
+	tlsKey = flag.String("tls-key", "",
+		"TLS key file for the TCP listener (requires -tls-cert)")
+	tlsClientCA = flag.String("tls-client-ca", "",
+		"CA file used to require and verify TLS client certificates")
+
+	maxLineLength = flag.Int("max-line-length", 64*1024,
+		"Maximum length of a TCP line; longer lines are dropped as invalid")
+	tcpIdleTimeout = flag.Duration("tcp-idle-timeout", 0,
+		"Close TCP connections that send nothing for this long (0 disables)")
+
+	maxConnections = flag.Int("max-connections", 0,
+		"Maximum concurrent TCP connections across all listeners; extra connections are closed (0 disables)")
+
+	acceptBackoff = flag.Duration("accept-backoff", time.Second,
+		"Maximum delay between retries after a temporary TCP accept error")
+
+	httpAddr = flag.String("http-addr", "",
+		"HTTP server address for /debug/vars (disabled if empty)")
+	enablePprof = flag.Bool("pprof", false,
+		"Serve net/http/pprof endpoints under /debug/pprof on -http-addr")
+
+	mgmtAddr = flag.String("mgmt-addr", "",
+		"TCP address of the management interface (disabled if empty)")
+
+	sanitize = flag.Bool("sanitize", false,
+		"Replace invalid characters in bucket names with underscores instead of rejecting the metric")
+
+	maxNameLength = flag.Int("max-name-length", 0,
+		"Longest bucket name accepted, see -long-name-policy (0 is unlimited)")
+	longNamePolicy = flag.String("long-name-policy", "reject",
+		"What to do with a bucket name over -max-name-length: reject or truncate")
+
+	relabelConfig = flag.String("relabel-config", "",
+		"JSON file of relabel rules (keep, drop, replace) applied to bucket names at flush")
+
+	renameRules = flag.String("rename-rules", "",
+		"File of pattern=replacement rules used to rename buckets on ingest")
+
+	rollupRules = flag.String("rollup-rules", "",
+		"File of regex=>template rules that sum matching counters and merge matching timers into extra buckets at flush")
+
+	lineEnding = flag.String("line-ending", "lf",
+		"Line terminator used in the Graphite output (lf or crlf)")
+
+	internalPrefix = flag.String("internal-prefix", "statsd",
+		"Prefix of the internal stats bucket names")
+	noInternalStats = flag.Bool("no-internal-stats", false,
+		"Don't emit internal stats")
+	internalStatsList = flag.String("internal-stats", "",
+		"Comma separated list of internal stats to emit, e.g. metrics.recv,uptime_seconds (all if empty)")
+	hostname = flag.String("hostname", defaultHostname(),
+		"Host name added to the internal stats bucket names with -internal-hostname")
+	internalHostname = flag.Bool("internal-hostname", false,
+		"Name internal stats <internal-prefix>.<hostname>.<stat> to tell daemons apart")
+
+	verifyFile = flag.String("verify-file", "",
+		"Ingest this file of metrics, flush once to -verify-out instead of Graphite and exit")
+	verifyOut = flag.String("verify-out", "-",
+		"File the -verify-file flush is written to (- for stdout)")
+
+	canary = flag.Bool("canary", false,
+		"Emit statsd.canary with the flush timestamp as its value to measure pipeline delay")
+
+	flushOrder = flag.String("flush-order", "",
+		"Comma separated order of flush sections: counters, gauges, timers, distributions, internal")
+
+	percentiles = flag.String("percentiles", "5,95",
+		"Comma separated list of timer percentiles to calculate")
+	percentileSuffix = flag.String("percentile-suffix", "perc",
+		"Name of timer and distribution percentiles, e.g. p for <bucket>.p95")
+	valuePrecision = flag.Int("value-precision", 6,
+		"Number of decimal places in timer and distribution values")
+	compactFloats = flag.Bool("compact-floats", false,
+		"Write timer and distribution values with the fewest digits that represent them, e.g. 12 not 12.000000")
+
+	// Webhook backend
+	webhookURL      = flag.String("webhook", "", "Webhook URL to POST each flush to")
+	webhookTemplate = flag.String("webhook-template", "",
+		"File containing the webhook body template (Go text/template)")
+	webhookTimeout = flag.Duration("webhook-timeout", 5*time.Second,
+		"Timeout for each webhook or Pushgateway request")
+	webhookRetries = flag.Int("webhook-retries", 3,
+		"Number of times to retry a failed webhook or Pushgateway request")
+
+	// Prometheus Pushgateway backend
+	pushgatewayURL = flag.String("pushgateway-url", "",
+		"Prometheus Pushgateway URL to PUT each flush to")
+	pushgatewayJob = flag.String("pushgateway-job", "statsdaemon",
+		"Job label for metrics pushed to the Pushgateway")
+
+	allowNegativeCounters = flag.Bool("allow-negative-counters", true,
+		"Accept negative counter values (reject them as invalid if false)")
+
+	counterRounding = flag.String("counter-rounding", "truncate",
+		"How sampled counter values are converted to integers: truncate or round")
+
+	// Unit conversion applied at flush; counts are never scaled
+	gaugeMultiplier = flag.Float64("gauge-multiplier", 1,
+		"Multiply gauge values by this at flush")
+	gaugeMinMax = flag.Bool("gauge-minmax", false,
+		"Also flush <bucket>.min and <bucket>.max of each gauge within the interval")
+	gaugeAggregation = flag.String("gauge-aggregation", "last",
+		"Value flushed for a gauge set several times in an interval: last, avg, min or max")
+	timerMultiplier = flag.Float64("timer-multiplier", 1,
+		"Multiply timer aggregates by this at flush, e.g. 0.001 for ms to s")
+	distributionMultiplier = flag.Float64("distribution-multiplier", 1,
+		"Multiply distribution aggregates by this at flush")
+
+	reportSampleRate = flag.Bool("report-sample-rate", false,
+		"Emit <bucket>.sample_rate with the last sample rate seen for each counter")
+	emitRawCounts = flag.Bool("emit-raw-counts", false,
+		"Emit <bucket>.raw with the sum of each counter's values before sample rate scaling")
+
+	syslogMode = flag.Bool("syslog", false,
+		"Strip RFC3164/RFC5424 syslog headers from each message and parse the rest as newline separated metrics")
+
+	fastCounters = flag.Bool("fast-counters", false,
+		"Aggregate counters directly in the listener goroutines, merging them at each flush")
+
+	blocklist = flag.String("blocklist", "",
+		"File of bucket patterns to drop at ingest")
+	allowlist = flag.String("allowlist", "",
+		"File of bucket patterns to accept at ingest; all other buckets are dropped")
+
+	maxBuckets = flag.Int("max-buckets", 0,
+		"Maximum distinct buckets per metric type; metrics for new buckets beyond it are dropped (0 disables)")
+
+	queueSize = flag.Int("queue-size", defaultQueueSize,
+		"Number of received metrics buffered for processing; metrics are dropped when it is full")
+
+	typeAliasList = flag.String("type-aliases", "h=ms",
+		"Comma separated alias=type metric types, e.g. h=ms to aggregate histograms as timers")
+
+	timerUnit = flag.String("timer-unit", "ms",
+		"Unit of timer values without a |u: unit (ns, us, ms or s); timers are converted to ms")
+
+	timerAlgorithm = flag.String("timer-algorithm", "exact",
+		"Timer percentile algorithm: exact (sorts every value) or tdigest (approximate, bounded memory)")
+
+	timerReservoirSize = flag.Int("timer-reservoir-size", 0,
+		"Keep at most this many sampled values per timer bucket per flush (0 keeps all)")
+
+	walPath = flag.String("wal-path", "",
+		"Snapshot file used to keep aggregated metrics across restarts")
+
+	deleteGauges = flag.Bool("delete-gauges", false,
+		"Delete gauges after flushing instead of re-sending the last value")
+	deleteCounters = flag.Bool("delete-counters", true,
+		"Delete counters after flushing instead of sending 0 for idle counters")
+	idleCounterFlushes = flag.Int("idle-counter-flushes", 60,
+		"With -delete-counters=false, delete a counter once it has sent 0 for this many flushes (0 keeps it forever)")
+	deleteTimers = flag.Bool("delete-timers", true,
+		"Delete timers after flushing instead of sending a 0 count for idle timers")
+
 	// Profiling
 	cpuprofile   = flag.Bool("cpuprofile", false, "Enable CPU profiling")
 	memprofile   = flag.Bool("memprofile", false, "Enable memory profiling")
 	blockprofile = flag.Bool("blockprofile", false, "Enable block profiling")
 
-	debug = flag.Bool("debug", false, "Enable debug mode")
+	stdin = flag.Bool("stdin", false,
+		"Read metrics from standard input, flush them once at EOF and exit")
+
+	replayFile = flag.String("replay-file", "",
+		"Replay a capture of metrics, optionally prefixed by their Unix capture time, then exit")
+	replayLoop = flag.Bool("replay-loop", false, "Replay -replay-file over and over")
+	replayRate = flag.Float64("replay-rate", 0,
+		"Replay this many lines per second instead of following the capture times (0 disables)")
+
+	dryRun = flag.Bool("dry-run", false,
+		"Aggregate metrics and log a summary of each flush without sending it")
+
+	debug     = flag.Bool("debug", false, "Enable debug mode")
+	logFormat = flag.String("log-format", "text", "Log format: text or json")
+
+	maxRatePerIP = flag.Float64("max-rate-per-ip", 0,
+		"Maximum metrics per second accepted from a single source IP (0 disables)")
+
+	maxInvalidSources = flag.Int("invalid-sources", 0,
+		"Track invalid metrics for up to this many source addresses (0 disables)")
+
+	topN = flag.Int("top-n", 0,
+		"Periodically log the N most updated buckets of each type (0 disables)")
+	topNFlushes = flag.Int("top-n-flushes", 10, "Log the -top-n buckets every this many flushes")
 )
 
 //-----------------------------------------------------------------------------
@@ -51,38 +291,183 @@ var (
 
 // Metric is a numeric data point
 type Metric struct {
-	Bucket string
-	Value  interface{}
-	Type   string
+	Bucket     string
+	Value      float64 // Gauge, timer and distribution value
+	CountValue int64   // Counter value
+	Type       string
+	SampleRate float64
+	Timestamp  int64 // Unix time sent with |T, or 0 for the flush time
+	Clear      bool  // Reset the counter before adding the value
+	RawCount   int64 // Counter value before sample rate scaling
 }
 
 // Metrics should be in statsd format. Metric names may not have spaces.
 //
 //     <metric_name>:<metric_value>|<metric_type>|@<sample_rate>
 //
-// Note: The sample rate is optional
+// Note: The sample rate is optional. Timers may give the unit of their value
+// (see timerUnits) after the type, e.g. mytimer:1.5|ms|u:s. A metric may be
+// backdated with |T<unix time>; only gauges are written with that time.
+//
+// As a non-standard extension, a counter sent with |clear (e.g.
+// gorets:0|c|clear) resets the value accumulated so far in the interval
+// before its own value is added.
 // var statsPattern = regexp.MustCompile(`[\w\.]+:-?\d+\|(?:c|ms|g)(?:\|\@[\d\.]+)?`)
 
-// In is a channel for processing metrics
-var In = make(chan *Metric)
+// timerUnits maps timer units to the factor that converts them to
+// milliseconds
+var timerUnits = map[string]float64{
+	"ns": 1e-6,
+	"us": 1e-3,
+	"ms": 1,
+	"s":  1e3,
+}
+
+// typeAliases maps metric types sent by some clients to the type they are
+// aggregated as (see -type-aliases)
+var typeAliases = map[string]string{"h": Timer}
+
+// parseTypeAliases parses a comma separated list of alias=type pairs. Each
+// type must be one of the built in metric types.
+func parseTypeAliases(s string) (map[string]string, error) {
+	aliases := make(map[string]string)
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+
+		if field == "" {
+			continue
+		}
+
+		i := strings.Index(field, "=")
+
+		if i < 1 || i == len(field)-1 {
+			return nil, fmt.Errorf("invalid type alias %q", field)
+		}
+
+		alias, typ := field[:i], field[i+1:]
+
+		switch typ {
+		case Counter, Gauge, Timer, Distribution:
+		default:
+			return nil, fmt.Errorf("unknown metric type %q in alias %q", typ, field)
+		}
+
+		aliases[alias] = typ
+	}
+
+	return aliases, nil
+}
+
+// metricType returns the metric type for a type field, resolving aliases
+func metricType(typ []byte) string {
+	if t, ok := typeAliases[string(typ)]; ok {
+		return t
+	}
+
+	return string(typ)
+}
+
+// In is a channel for processing metrics. It is buffered (see -queue-size)
+// so listeners don't stall while a flush is running.
+var In = make(chan *Metric, defaultQueueSize)
+
+// defaultQueueSize is the default capacity of In
+const defaultQueueSize = 10000
 
-// counters holds all of the counter metrics
+// counters holds all of the counter metrics. When -report-sample-rate is
+// set, rates holds the last sample rate seen for each bucket this interval.
+// When -emit-raw-counts is set, raw holds the sum of the values as received.
+// With -delete-counters=false, idle counts the flushes in a row each counter
+// has been idle for.
 var counters = struct {
 	sync.RWMutex
-	m map[string]int64
-}{m: make(map[string]int64)}
+	m     map[string]int64
+	rates map[string]float64
+	raw   map[string]int64
+	idle  map[string]int
+
+	// window holds each counter's deltas over the last -counter-window
+	// flushes in a ring indexed by windowPos
+	window    map[string][]int64
+	windowPos int
+}{
+	m:      make(map[string]int64),
+	rates:  make(map[string]float64),
+	raw:    make(map[string]int64),
+	idle:   make(map[string]int),
+	window: make(map[string][]int64),
+}
+
+// counterShardCount is the number of -fast-counters shards
+const counterShardCount = 16
+
+// counterShards hold the counters added by -fast-counters. They are sharded
+// by bucket so listener goroutines rarely contend for a lock, and merged
+// into counters at each flush.
+var counterShards [counterShardCount]struct {
+	sync.Mutex
+	m map[string]fastCounter
+}
 
-// gauges holds all of the gauge metrics
+// fastCounter is a counter held in a -fast-counters shard, with the number
+// of metrics added to it and the last sample rate seen
+type fastCounter struct {
+	value   int64
+	updates uint64
+	rate    float64
+}
+
+// gauges holds all of the gauge metrics. A gauge explicitly set to 0 is
+// stored and emitted like any other value; only gauges that have never been
+// set (or were deleted by -delete-gauges) are absent from a flush. With
+// -gauge-minmax, min and max hold the range each gauge was set to during
+// the current interval, and with -gauge-aggregation=avg, sum and count
+// hold the values it was set to. times holds the |T timestamp of gauges
+// whose last value was backdated.
 var gauges = struct {
 	sync.RWMutex
-	m map[string]float64
-}{m: make(map[string]float64)}
+	m     map[string]float64
+	min   map[string]float64
+	max   map[string]float64
+	sum   map[string]float64
+	count map[string]int64
+	times map[string]int64
+}{
+	m:     make(map[string]float64),
+	min:   make(map[string]float64),
+	max:   make(map[string]float64),
+	sum:   make(map[string]float64),
+	count: make(map[string]int64),
+	times: make(map[string]int64),
+}
 
 // Timers is a list of floats
 type Timers []float64
 
-// timers holds all of the timer metrics
+// timers holds all of the timer metrics. When -timer-reservoir-size is set,
+// m holds a uniform sample of each bucket's values and dropped counts the
+// observations that were not kept. sampled counts the observations that
+// clients didn't send because of their sample rate, so the true count is
+// len(m[k])+dropped[k]+sampled[k]. With -timer-algorithm tdigest, values
+// are added to digests instead and m holds an empty entry for each bucket.
 var timers = struct {
+	sync.RWMutex
+	m       map[string]Timers
+	dropped map[string]int64
+	sampled map[string]float64
+	digests map[string]*TDigest
+}{
+	m:       make(map[string]Timers),
+	dropped: make(map[string]int64),
+	sampled: make(map[string]float64),
+	digests: make(map[string]*TDigest),
+}
+
+// distributions holds all of the distribution metrics. Distributions are
+// collected like timers but flushed under <bucket>.distribution.* so they
+// don't collide with timers of the same name.
+var distributions = struct {
 	sync.RWMutex
 	m map[string]Timers
 }{m: make(map[string]Timers)}
@@ -94,6 +479,18 @@ type Stats struct {
 	RecvMetrics    uint64
 	SentMetrics    uint64
 	InvalidMetrics uint64
+	RateLimited    uint64
+	QueueDropped   uint64
+
+	CardinalityDropped uint64
+	Filtered           uint64
+	RelabelDropped     uint64
+	ListenerErrors     uint64
+
+	ConnectionsRejected uint64
+
+	RecvBytesUDP uint64
+	RecvBytesTCP uint64
 
 	RecvCounters uint64
 	SentCounters uint64
@@ -101,12 +498,155 @@ type Stats struct {
 	SentGauges   uint64
 	RecvTimers   uint64
 	SentTimers   uint64
+
+	RecvDistributions uint64
+	SentDistributions uint64
+
+	// Buckets held by each type at the start of the last flush
+	ActiveCounters      uint64
+	ActiveGauges        uint64
+	ActiveTimers        uint64
+	ActiveDistributions uint64
 }
 
 var stats = &Stats{}
 
-// TODO: move this to command line option
-var Percentiles = []int{5, 95}
+// startTime is when the process started, used to report uptime
+var startTime = time.Now()
+
+// invalidSources counts invalid metrics per source address. Sources beyond
+// the -invalid-sources limit are counted under "other".
+var invalidSources = struct {
+	sync.Mutex
+	m map[string]uint64
+}{m: make(map[string]uint64)}
+
+// eol terminates each line written to the flush buffer (see -line-ending)
+var eol = "\n"
+
+// internalStats is the set of internal stats to emit (see -internal-stats).
+// A nil set emits all of them.
+var internalStats map[string]bool
+
+// flushSections lists the sections of a flush in their default order
+var flushSections = []string{"counters", "gauges", "timers", "distributions",
+	"internal"}
+
+// FlushOrder is the order sections are written in each flush (see
+// -flush-order)
+var FlushOrder = flushSections
+
+// FlushJitter is the maximum random offset of the first flush (see
+// -flush-jitter)
+var FlushJitter time.Duration
+
+// sectionInterval returns the interval a flush section is flushed at.
+// Distributions and internal stats always flush every -flush-interval.
+func sectionInterval(name string) time.Duration {
+	var d time.Duration
+
+	switch name {
+	case "counters":
+		d = *counterFlushInterval
+	case "gauges":
+		d = *gaugeFlushInterval
+	case "timers":
+		d = *timerFlushInterval
+	}
+
+	if d <= 0 {
+		return *flushInterval
+	}
+
+	return d
+}
+
+// flushGroup is a set of flush sections that share an interval
+type flushGroup struct {
+	interval time.Duration
+	sections []string
+}
+
+// flushGroups groups the flush sections by their interval. Without any
+// per-type intervals there is a single group of every section.
+func flushGroups() []flushGroup {
+	var groups []flushGroup
+
+	for _, name := range flushSections {
+		d := sectionInterval(name)
+		i := 0
+
+		for i < len(groups) && groups[i].interval != d {
+			i++
+		}
+
+		if i == len(groups) {
+			groups = append(groups, flushGroup{interval: d})
+		}
+
+		groups[i].sections = append(groups[i].sections, name)
+	}
+
+	return groups
+}
+
+// parseFlushJitter parses a jitter given as a duration (2s) or as a
+// percentage of the flush interval (20%)
+func parseFlushJitter(s string, interval time.Duration) (time.Duration, error) {
+	var d time.Duration
+
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+
+		if err != nil {
+			return 0, err
+		}
+
+		d = time.Duration(float64(interval) * pct / 100)
+	} else {
+		var err error
+		d, err = time.ParseDuration(s)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if d < 0 || d > interval {
+		return 0, fmt.Errorf("jitter %s must be between 0 and the flush interval", s)
+	}
+
+	return d, nil
+}
+
+// firstFlushDelay returns the delay before the first flush: the interval
+// plus a random offset of up to jitter. Later flushes follow at the
+// interval, so only the phase of the flushes is randomized.
+func firstFlushDelay(interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+
+	return interval + time.Duration(rand.Int63n(int64(jitter)+1))
+}
+
+// percentileList holds the []float64 of timer percentiles to calculate (see
+// -percentiles). It is swapped atomically when the configuration is reloaded.
+var percentileList atomic.Value
+
+func init() {
+	percentileList.Store([]float64{5, 95})
+}
+
+// Percentiles returns the current list of timer percentiles
+func Percentiles() []float64 {
+	return percentileList.Load().([]float64)
+}
+
+// setPercentiles replaces the list of timer percentiles
+func setPercentiles(pcts []float64) {
+	percentileList.Store(pcts)
+}
 
 //-----------------------------------------------------------------------------
 
@@ -117,9 +657,78 @@ func (t Timers) Less(i, j int) bool { return t[i] < t[j] }
 
 //-----------------------------------------------------------------------------
 
-// ListenUDP creates a UDP listener
-func ListenUDP(addr string) error {
-	var buf = make([]byte, 1024)
+// NamedListener is a listener pair whose metrics are prefixed with its name
+type NamedListener struct {
+	Name string
+	Addr string
+}
+
+// Prefix returns the bucket prefix for metrics received by the listener, or
+// "" for an unnamed listener
+func (l NamedListener) Prefix() string {
+	if l.Name == "" {
+		return ""
+	}
+
+	return l.Name + "."
+}
+
+// parseListenAddrs parses a comma separated list of listen addresses into
+// unnamed listeners. IPv6 hosts must be bracketed, e.g. [::1]:8125.
+func parseListenAddrs(s string) ([]NamedListener, error) {
+	var listeners []NamedListener
+
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+
+		if addr == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %v", addr, err)
+		}
+
+		listeners = append(listeners, NamedListener{Addr: addr})
+	}
+
+	return listeners, nil
+}
+
+// parseListeners parses a comma separated list of name=addr listeners
+func parseListeners(s string) ([]NamedListener, error) {
+	var listeners []NamedListener
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+
+		if field == "" {
+			continue
+		}
+
+		i := strings.Index(field, "=")
+
+		if i < 1 || i == len(field)-1 {
+			return nil, fmt.Errorf("invalid listener %q: must be name=addr", field)
+		}
+
+		name := field[:i]
+
+		for j := 0; j < len(name); j++ {
+			if !validBucketChar(name[j]) {
+				return nil, fmt.Errorf("invalid character %q in listener name %q",
+					name[j], name)
+			}
+		}
+
+		listeners = append(listeners, NamedListener{Name: name, Addr: field[i+1:]})
+	}
+
+	return listeners, nil
+}
+
+// ListenUDP creates a UDP listener. Buckets are prefixed with prefix.
+func ListenUDP(addr, prefix string) error {
 	ln, err := net.ResolveUDPAddr("udp", addr)
 
 	if err != nil {
@@ -132,35 +741,48 @@ func ListenUDP(addr string) error {
 		return err
 	}
 
-	log.Printf("Listening on UDP %s\n", ln)
+	logInfo("Listening on UDP", "addr", sock.LocalAddr())
+	return serveUDP(sock, prefix)
+}
+
+// serveUDP reads datagrams from a UDP socket until it is closed. Other read
+// errors are logged and counted, and reading continues.
+func serveUDP(sock *net.UDPConn, prefix string) error {
+	var buf = make([]byte, 1024)
 
 	for {
 		n, raddr, err := sock.ReadFromUDP(buf[:])
 
 		if err != nil {
-			// TODO: handle error
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			atomic.AddUint64(&stats.ListenerErrors, 1)
+			logWarn("Unable to read from UDP socket", "addr", sock.LocalAddr(),
+				"error", err)
 			continue
 		}
 
+		atomic.AddUint64(&stats.RecvBytesUDP, uint64(n))
+		recordPacketSize(n)
+
 		if *debug {
-			log.Printf("DEBUG: Received UDP message: bytes=%d client=%s",
-				n, raddr)
+			logDebug("Received UDP message", "bytes", n,
+				"client", raddr)
 		}
 
-		go handleUdpMessage(buf)
-	}
-}
-
-func handleUdpMessage(buf []byte) {
-	tokens := bytes.Split(buf, []byte("\n"))
+		// Copy the datagram since buf is reused by the next read
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
 
-	for _, token := range tokens {
-		handleMessage(token)
+		go handleMessage(msg, raddr, prefix)
 	}
 }
 
-// ListenTCP creates a TCP listener
-func ListenTCP(addr string) error {
+// ListenTCP creates a TCP listener. Connections are encrypted if -tls-cert
+// and -tls-key are set. Buckets are prefixed with prefix.
+func ListenTCP(addr, prefix string) error {
 	l, err := net.Listen("tcp", addr)
 
 	if err != nil {
@@ -168,313 +790,1724 @@ func ListenTCP(addr string) error {
 	}
 
 	defer l.Close()
-	log.Printf("Listening on TCP %s\n", l.Addr())
 
-	for {
-		conn, err := l.Accept()
+	if *tlsCert != "" && *tlsKey != "" {
+		cfg, err := serverTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
 
 		if err != nil {
-			// TODO: handle error
-			continue
+			return err
 		}
 
-		go handleConnection(conn)
+		l = tls.NewListener(l, cfg)
+		logInfo("Listening on TCP", "addr", l.Addr(), "tls", true)
+	} else {
+		logInfo("Listening on TCP", "addr", l.Addr())
 	}
+
+	return serveTCP(l, prefix, connSlots)
 }
 
-// handleConnection handles a single client connection
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-	r := bufio.NewReader(conn)
+// serveTCP accepts connections on a listener, holding one of slots for each
+// open connection (see connSlots). Temporary accept errors (e.g. running out
+// of file descriptors) are retried with an exponential backoff of up to
+// -accept-backoff so they don't spin the CPU; any other error is returned.
+// Closing the listener isn't counted as an error. Before returning, the open
+// connections are closed and their handlers waited for.
+func serveTCP(l net.Listener, prefix string, slots chan struct{}) error {
+	var delay time.Duration
+	var handlers sync.WaitGroup
+	var mu sync.Mutex
+	open := make(map[net.Conn]bool)
+
+	defer func() {
+		mu.Lock()
+
+		for conn := range open {
+			conn.Close()
+		}
+
+		mu.Unlock()
+		handlers.Wait()
+	}()
 
-	// Incoming metrics should be separated by a newline
 	for {
-		line, err := r.ReadBytes('\n')
+		conn, err := l.Accept()
 
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				// TODO: handle error
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			atomic.AddUint64(&stats.ListenerErrors, 1)
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+
+				if delay > *acceptBackoff {
+					delay = *acceptBackoff
+				}
+
+				logWarn("Unable to accept connection", "retry", delay,
+					"error", err)
+				time.Sleep(delay)
+				continue
 			}
+
+			return err
 		}
 
-		if *debug {
-			log.Printf("DEBUG: Received TCP message: bytes=%d client=%s",
-				len(line), conn.RemoteAddr())
+		delay = 0
+
+		if !acquireConn(slots) {
+			atomic.AddUint64(&stats.ConnectionsRejected, 1)
+			logWarn("Too many connections, closing", "client", conn.RemoteAddr(),
+				"max", cap(slots))
+			conn.Close()
+			continue
 		}
 
-		handleMessage(line)
+		mu.Lock()
+		open[conn] = true
+		mu.Unlock()
+		handlers.Add(1)
+
+		go func() {
+			defer handlers.Done()
+			defer releaseConn(slots)
+			handleConnection(conn, prefix)
+
+			mu.Lock()
+			delete(open, conn)
+			mu.Unlock()
+		}()
 	}
 }
 
-// Handle an event message
-func handleMessage(buf []byte) {
-	atomic.AddUint64(&stats.RecvMessages, 1)
+// connSlots limits the number of open TCP connections to its capacity (see
+// -max-connections). A nil channel means no limit.
+var connSlots chan struct{}
 
-	// According to the statsd protocol, metrics should be separated by a
-	// newline. This parser isn't quite as strict since it may be receiving
-	// metrics from clients that aren't proper statsd clients (e.g. syslog).
-	// In that case, the code tries to remove any client prefix by considering
-	// everything after the last space as the list of metrics.
+// acquireConn takes a connection slot, reporting false if none are free
+func acquireConn(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
 
-	buf = bytes.TrimSpace(buf)
-	i := bytes.LastIndex(buf, []byte(" "))
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
 
-	if i > -1 {
-		buf = buf[i+1 : len(buf)]
+// releaseConn frees a slot taken by acquireConn
+func releaseConn(slots chan struct{}) {
+	if slots != nil {
+		<-slots
 	}
+}
 
-	tokens := bytes.Split(buf, []byte("\n"))
+// handleConnection handles a single client connection. A client may send
+// "PREFIX <prefix>" as its first line to prepend a prefix to the buckets of
+// every metric it sends afterwards, after the listener's own prefix.
+func handleConnection(conn net.Conn, prefix string) {
+	defer conn.Close()
+	r := newLineReader(conn)
+	first := true
 
-	for _, token := range tokens {
-		// metrics must have a : and | at a minimum
-		if !bytes.Contains(token, []byte(":")) ||
-			!bytes.Contains(token, []byte("|")) {
-			atomic.AddUint64(&stats.InvalidMetrics, 1)
-			continue
+	// Incoming metrics should be separated by a newline
+	for {
+		if *tcpIdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(*tcpIdleTimeout))
 		}
 
-		if *debug {
-			log.Printf("DEBUG: Parsing metric from token: %q", string(token))
+		line, tooLong, err := readLine(r)
+		atomic.AddUint64(&stats.RecvBytesTCP, uint64(len(line)))
+
+		if len(line) > 0 {
+			recordPacketSize(len(line))
 		}
 
-		metric, err := parseMetric(token)
+		if tooLong {
+			countInvalid(conn.RemoteAddr())
+		}
 
 		if err != nil {
-			if *debug {
-				log.Printf("ERROR: Unable to parse metric %q: %s",
-					token, err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				logInfo("Closing idle connection", "client", conn.RemoteAddr())
+			} else if err == io.EOF {
+				// The client closed the connection, so unterminated data
+				// left in the buffer is a complete final line
+				if len(line) > 0 && !tooLong {
+					handleMessage(line, conn.RemoteAddr(), prefix)
+				}
+			} else {
+				logError("Unable to read from connection",
+					"client", conn.RemoteAddr(), "error", err)
 			}
 
-			atomic.AddUint64(&stats.InvalidMetrics, 1)
+			break
+		}
+
+		if tooLong {
 			continue
 		}
 
-		// Send metric off for processing
-		In <- metric
+		if first {
+			first = false
+			p, ok, err := parseHandshake(line)
+
+			if err != nil {
+				countInvalid(conn.RemoteAddr())
+				logWarn("Closing connection with invalid handshake",
+					"client", conn.RemoteAddr(), "error", err)
+				break
+			}
+
+			if ok {
+				prefix += p
+				continue
+			}
+		}
 
 		if *debug {
-			log.Printf("DEBUG: Queued metric for processing: %+v", metric)
+			logDebug("Received TCP message", "bytes", len(line),
+				"client", conn.RemoteAddr())
 		}
+
+		handleMessage(line, conn.RemoteAddr(), prefix)
 	}
 }
 
-// parseMetric parses a raw metric into a Metric struct
-func parseMetric(b []byte) (*Metric, error) {
-	// Remove any whitespace characters
-	b = bytes.TrimSpace(b)
+// parseHandshake reports whether line is a "PREFIX <prefix>" handshake and
+// returns the prefix. The prefix may only contain characters valid in a
+// bucket name.
+func parseHandshake(line []byte) (string, bool, error) {
+	line = bytes.TrimSpace(line)
 
-	// Find positions of the various separators
-	i := bytes.Index(b, []byte(":"))
-	j := bytes.Index(b, []byte("|"))
-	k := bytes.Index(b, []byte("@"))
-	v := b[i+1 : j]
-
-	// End position of the metric type is the end of the byte slice
-	// if no sample rate was sent.
-	tEnd := len(b)
-	var sampleRate float64 = 1
-
-	// Indicates that a sample rate was sent as part of the metric
-	if k > -1 {
-		tEnd = k - 1 // Use -1 because of the | before the @
-		sr := b[(k + 1):len(b)]
-		var err error
-		sampleRate, err = strconv.ParseFloat(string(sr), 64)
-
-		if err != nil {
-			return nil, err
-		}
+	if !bytes.HasPrefix(line, []byte("PREFIX ")) {
+		return "", false, nil
 	}
 
-	m := &Metric{
-		Bucket: string(b[0:i]),
-		Type:   string(b[j+1 : tEnd]),
-	}
+	p := bytes.TrimSpace(line[len("PREFIX "):])
 
-	switch m.Type {
-	case Counter:
-		val, err := strconv.ParseInt(string(v), 10, 64)
+	if len(p) == 0 {
+		return "", true, fmt.Errorf("empty prefix")
+	}
 
-		if err != nil {
-			return nil, err
+	for _, c := range p {
+		if !validBucketChar(c) {
+			return "", true, fmt.Errorf("invalid prefix %q", p)
 		}
+	}
 
-		m.Value = int64(float64(val) / sampleRate)
-
-	case Gauge, Timer:
-		val, err := strconv.ParseFloat(string(v), 64)
+	return string(p), true, nil
+}
 
-		if err != nil {
-			return nil, err
-		}
+// newLineReader returns a reader for readLine whose buffer fits a line of
+// -max-line-length bytes and its newline
+func newLineReader(r io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(r, *maxLineLength+1)
+}
 
-		m.Value = val
+// readLine reads a newline terminated line from r, buffering a partial line
+// across reads until its newline arrives. At EOF the unterminated remainder
+// is returned with the error. The line is only valid until the next read.
+// A line that doesn't fit in r's buffer is discarded up to the next newline
+// without being buffered and reported as too long.
+func readLine(r *bufio.Reader) ([]byte, bool, error) {
+	line, err := r.ReadSlice('\n')
 
-	default:
-		err := fmt.Errorf("unable to create metric for type %q", m.Type)
+	if err != bufio.ErrBufferFull {
+		return line, false, err
+	}
 
-		return nil, err
+	for err == bufio.ErrBufferFull {
+		_, err = r.ReadSlice('\n')
 	}
 
-	return m, nil
+	return nil, true, err
 }
 
-// processMetrics updates new metrics and flushes aggregates to Graphite
-func processMetrics() {
-	ticker := time.NewTicker(FlushInterval)
-
-	for {
+// Handle an event message received from src. src may be nil if the
+// sender is unknown. Buckets are prefixed with prefix.
+func handleMessage(buf []byte, src net.Addr, prefix string) {
+	parseMessage(buf, src, prefix, func(metric *Metric) {
+		// Send metric off for processing, dropping it if the queue is full
 		select {
-		case <-ticker.C:
-			flushMetrics()
-		case m := <-In:
-			atomic.AddUint64(&stats.RecvMetrics, 1)
-
+		case In <- metric:
 			if *debug {
-				log.Printf("DEBUG: Received metric for processing: %+v", m)
+				logDebug("Queued metric for processing", "metric", metric)
 			}
+		default:
+			atomic.AddUint64(&stats.QueueDropped, 1)
+		}
+	})
+}
 
-			switch m.Type {
-			case Counter:
-				counters.Lock()
-				counters.m[m.Bucket] += m.Value.(int64)
-				counters.Unlock()
-				atomic.AddUint64(&stats.RecvCounters, 1)
-
-			case Gauge:
-				gauges.Lock()
-				gauges.m[m.Bucket] = m.Value.(float64)
-				gauges.Unlock()
-				atomic.AddUint64(&stats.RecvGauges, 1)
-
-			case Timer:
-				timers.Lock()
-				_, ok := timers.m[m.Bucket]
-
-				if !ok {
-					var t Timers
-					timers.m[m.Bucket] = t
-				}
-
-				timers.m[m.Bucket] = append(timers.m[m.Bucket], m.Value.(float64))
-				timers.Unlock()
-				atomic.AddUint64(&stats.RecvTimers, 1)
-
-			default:
-				if *debug {
-					log.Printf("DEBUG: Unable to process unknown metric type %q", m.Type)
-				}
+// parseMessage parses the metrics in a message and passes each one to emit
+func parseMessage(buf []byte, src net.Addr, prefix string, emit func(*Metric)) {
+	atomic.AddUint64(&stats.RecvMessages, 1)
 
-			}
+	// With -syslog the message is a syslog line wrapping the metrics
+	if *syslogMode {
+		body, err := stripSyslogHeader(buf)
 
+		if err != nil {
 			if *debug {
-				log.Printf("DEBUG: Finished processing metric: %+v", m)
+				logError("Unable to parse syslog message",
+					"message", string(buf), "error", err)
 			}
+
+			countInvalid(src)
+			return
 		}
+
+		buf = body
 	}
-}
 
-// flushMetrics sends metrics to Graphite
-func flushMetrics() {
-	var buf bytes.Buffer
-	now := time.Now().Unix()
+	// According to the statsd protocol, metrics should be separated by a
+	// newline. This parser isn't quite as strict since it may be receiving
+	// metrics from clients that aren't proper statsd clients. Unless -syslog
+	// is set, the code tries to remove any client prefix from each line by
+	// considering everything after the last space as the metric.
 
-	// Build buffer of stats
-	nCounters := flushCounters(&buf, now)
-	nGauges := flushGauges(&buf, now)
-	nTimers := flushTimers(&buf, now)
+	tokens := bytes.Split(bytes.TrimSpace(buf), []byte("\n"))
 
-	stats.SentMetrics = nCounters + nGauges + nTimers
-	stats.SentCounters = nCounters
-	stats.SentGauges = nGauges
-	stats.SentTimers = nTimers
+	for _, token := range tokens {
+		token = bytes.TrimSpace(token)
 
-	log.Printf("STATS: %+v", *stats)
+		if i := bytes.LastIndex(token, []byte(" ")); i > -1 && !*syslogMode {
+			token = token[i+1:]
+		}
 
-	// Add to internal stats and flush
-	fmt.Fprintln(&buf, "statsd.metrics.sent", nCounters+nGauges+nTimers, now)
-	fmt.Fprintln(&buf, "statsd.counters.sent", nCounters, now)
-	fmt.Fprintln(&buf, "statsd.gauges.sent", nGauges, now)
-	fmt.Fprintln(&buf, "statsd.timers.sent", nTimers, now)
-	flushInternalStats(&buf, now)
+		// Blank lines (e.g. from double newlines) are harmless
+		if len(token) == 0 {
+			continue
+		}
 
-	// Send metrics to Graphite
-	sendGraphite(&buf)
-}
+		if limiter != nil && src != nil && !limiter.Allow(sourceHost(src)) {
+			atomic.AddUint64(&stats.RateLimited, 1)
+			continue
+		}
 
-// flushInternalStats writes the internal stats to the buffer
-func flushInternalStats(buf *bytes.Buffer, now int64) {
-	//fmt.Fprintf(buf, "statsd.metrics.per_second %d %d\n", v, now)
-	fmt.Fprintln(buf, "statsd.metrics.recv",
-		atomic.LoadUint64(&stats.RecvMetrics), now)
-	fmt.Fprintln(buf, "statsd.counters.recv",
-		atomic.LoadUint64(&stats.RecvCounters), now)
-	fmt.Fprintln(buf, "statsd.gauges.recv",
-		atomic.LoadUint64(&stats.RecvGauges), now)
-	fmt.Fprintln(buf, "statsd.timers.recv",
-		atomic.LoadUint64(&stats.RecvTimers), now)
-
-	// Clear internal metrics
-	atomic.StoreUint64(&stats.RecvMessages, 0)
+		// metrics must have a : and | at a minimum
+		if !bytes.Contains(token, []byte(":")) ||
+			!bytes.Contains(token, []byte("|")) {
+			countInvalid(src)
+			continue
+		}
 
-	atomic.StoreUint64(&stats.RecvMetrics, 0)
-	atomic.StoreUint64(&stats.SentMetrics, 0)
+		if *debug {
+			logDebug("Parsing metric from token", "token", string(token))
+		}
+
+		// Counters skip the Metric and the In channel with -fast-counters
+		if *fastCounters {
+			if ok, err := addFastCounter(token, prefix); ok {
+				if err != nil {
+					countInvalid(src)
+				}
+
+				continue
+			}
+		}
+
+		metric, err := parseMetric(token)
+
+		if err != nil {
+			if *debug {
+				logError("Unable to parse metric",
+					"token", string(token), "error", err)
+			}
+
+			countInvalid(src)
+			continue
+		}
+
+		metric.Bucket = prefix + metric.Bucket
+
+		if filterBucket(metric.Bucket) {
+			continue
+		}
+
+		emit(metric)
+	}
+}
+
+// sourceHost returns the host part of a source address
+func sourceHost(src net.Addr) string {
+	host, _, err := net.SplitHostPort(src.String())
+
+	if err != nil {
+		return src.String()
+	}
+
+	return host
+}
+
+// countInvalid records an invalid metric received from src
+func countInvalid(src net.Addr) {
+	atomic.AddUint64(&stats.InvalidMetrics, 1)
+
+	if *maxInvalidSources < 1 || src == nil {
+		return
+	}
+
+	host := sourceHost(src)
+
+	invalidSources.Lock()
+	defer invalidSources.Unlock()
+
+	if _, ok := invalidSources.m[host]; !ok &&
+		len(invalidSources.m) >= *maxInvalidSources {
+		host = "other"
+	}
+
+	invalidSources.m[host]++
+}
+
+// parseMetric parses a raw metric into a Metric struct
+func parseMetric(b []byte) (*Metric, error) {
+	p, err := splitMetric(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metric{
+		Bucket:     p.bucket,
+		Type:       metricType(p.typ),
+		SampleRate: p.sampleRate,
+		Timestamp:  p.timestamp,
+		Clear:      p.clear,
+	}
+
+	if m.Clear && m.Type != Counter {
+		return nil, fmt.Errorf("clear is only valid for counters")
+	}
+
+	switch m.Type {
+	case Counter:
+		val, err := parseCounter(p.value, p.sampleRate)
+
+		if err != nil {
+			return nil, err
+		}
+
+		m.CountValue = val
+
+		if *emitRawCounts {
+			m.RawCount, _ = parseCounter(p.value, 1)
+		}
+
+	case Gauge, Timer, Distribution:
+		val, err := strconv.ParseFloat(string(p.value), 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// ParseFloat accepts NaN and Inf, which would poison the aggregates
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return nil, fmt.Errorf("invalid value %q", p.value)
+		}
+
+		// Timers are aggregated in milliseconds whatever unit they are
+		// sent in. Units don't apply to other types.
+		if m.Type == Timer {
+			scale, ok := timerUnits[p.unit]
+
+			if !ok {
+				return nil, fmt.Errorf("unknown timer unit %q", p.unit)
+			}
+
+			val *= scale
+		}
+
+		m.Value = val
+
+	default:
+		err := fmt.Errorf("unable to create metric for type %q", m.Type)
+
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// metricParts holds the fields of a metric split by splitMetric
+type metricParts struct {
+	bucket     string
+	value      []byte
+	typ        []byte
+	sampleRate float64
+	unit       string
+	timestamp  int64
+	clear      bool
+}
+
+// splitMetric splits a metric into its fields. The bucket is validated and
+// renamed but the value is left unparsed.
+func splitMetric(b []byte) (metricParts, error) {
+	var p metricParts
+
+	// Remove any whitespace characters
+	b = bytes.TrimSpace(b)
+
+	// The value sits between the first : and the first |
+	i := bytes.IndexByte(b, ':')
+	j := bytes.IndexByte(b, '|')
+
+	if i < 0 || j < i {
+		return p, fmt.Errorf("invalid metric %q", b)
+	}
+
+	p.value = b[i+1 : j]
+	name := b[0:i]
+
+	if *maxNameLength > 0 && len(name) > *maxNameLength {
+		if *longNamePolicy != "truncate" {
+			return p, fmt.Errorf("bucket name of %d bytes exceeds -max-name-length",
+				len(name))
+		}
+
+		name = name[:*maxNameLength]
+	}
+
+	bucket, err := checkBucket(name)
+
+	if err != nil {
+		return p, err
+	}
+
+	p.bucket = currentRenames().Rename(bucket)
+	p.sampleRate = 1
+	p.unit = *timerUnit
+
+	// The remaining |-separated segments are classified by their leading
+	// character, so the sample rate (@0.1) and extensions such as a unit
+	// (u:s) may come before or after the type
+	for rest := b[j+1:]; rest != nil; {
+		seg := rest
+		rest = nil
+
+		if n := bytes.IndexByte(seg, '|'); n > -1 {
+			seg, rest = seg[:n], seg[n+1:]
+		}
+
+		switch {
+		case bytes.HasPrefix(seg, []byte("@")):
+			p.sampleRate, err = parseSampleRate(seg[1:])
+
+			if err != nil {
+				return p, err
+			}
+
+		case bytes.HasPrefix(seg, []byte("u:")):
+			p.unit = string(seg[2:])
+
+		case bytes.Equal(seg, []byte("clear")):
+			p.clear = true
+
+		case bytes.HasPrefix(seg, []byte("T")):
+			p.timestamp, err = strconv.ParseInt(string(seg[1:]), 10, 64)
+
+			if err != nil || p.timestamp < 1 {
+				return p, fmt.Errorf("invalid timestamp %q", seg)
+			}
+
+		case p.typ == nil:
+			p.typ = seg
+
+		default:
+			return p, fmt.Errorf("unknown metric extension %q", seg)
+		}
+	}
+
+	return p, nil
+}
+
+// parseSampleRate parses a sample rate given as a fraction (0.5) or a
+// percentage (50%). The rate must be in (0, 1].
+func parseSampleRate(b []byte) (float64, error) {
+	percent := bytes.HasSuffix(b, []byte("%"))
+
+	if percent {
+		b = b[:len(b)-1]
+	}
+
+	rate, err := strconv.ParseFloat(string(b), 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if percent {
+		rate /= 100
+	}
+
+	// Also rejects NaN
+	if !(rate > 0 && rate <= 1) {
+		return 0, fmt.Errorf("sample rate %v out of range (0, 1]", rate)
+	}
+
+	return rate, nil
+}
+
+// parseCounter parses a counter value and scales it by its sample rate
+func parseCounter(v []byte, sampleRate float64) (int64, error) {
+	val, err := strconv.ParseInt(string(v), 10, 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if val < 0 && !*allowNegativeCounters {
+		return 0, fmt.Errorf("negative counter value %d", val)
+	}
+
+	return roundCounter(float64(val) / sampleRate), nil
+}
+
+// roundCounter converts a sample-adjusted counter value to an integer using
+// the -counter-rounding policy
+func roundCounter(v float64) int64 {
+	if *counterRounding == "round" {
+		return int64(math.Floor(v + 0.5))
+	}
+
+	// Dividing by a rate such as 7e-2 can land just short of the exact
+	// quotient (99.99999999999999), which mustn't be truncated to 99
+	if r := math.Floor(v + 0.5); math.Abs(v-r) <= 1e-9*math.Abs(r) {
+		return int64(r)
+	}
+
+	return int64(v)
+}
+
+// validBucketChar reports whether c may appear in a bucket name
+func validBucketChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-'
+}
+
+// checkBucket validates a bucket name. Names may only contain
+// [A-Za-z0-9._-]; with -sanitize, any other character is replaced by an
+// underscore rather than rejecting the name.
+func checkBucket(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", fmt.Errorf("empty bucket name")
+	}
+
+	for i := 0; i < len(b); i++ {
+		if validBucketChar(b[i]) {
+			continue
+		}
+
+		if !*sanitize {
+			return "", fmt.Errorf("invalid character %q in bucket name %q",
+				b[i], b)
+		}
+
+		s := make([]byte, len(b))
+
+		for j := range b {
+			if validBucketChar(b[j]) {
+				s[j] = b[j]
+			} else {
+				s[j] = '_'
+			}
+		}
+
+		return string(s), nil
+	}
+
+	return string(b), nil
+}
+
+// processMetrics updates new metrics and flushes aggregates to Graphite.
+// Each group of flush sections is flushed on its own schedule, but always
+// from this goroutine.
+func processMetrics() {
+	due := make(chan []string)
+
+	for _, g := range flushGroups() {
+		go scheduleFlush(g, due)
+	}
+
+	for {
+		select {
+		case sections := <-due:
+			flushMetrics(sections)
+		case m := <-In:
+			processMetric(m)
+		}
+	}
+}
+
+// scheduleFlush sends the group's sections to due every interval. The first
+// flush is offset by up to FlushJitter so daemons started together don't all
+// flush at the same moment.
+func scheduleFlush(g flushGroup, due chan<- []string) {
+	time.Sleep(firstFlushDelay(g.interval, FlushJitter))
+	due <- g.sections
+
+	tick := time.NewTicker(g.interval)
+	defer tick.Stop()
+
+	for range tick.C {
+		due <- g.sections
+	}
+}
+
+// processMetric adds a metric to the aggregates
+func processMetric(m *Metric) {
+	atomic.AddUint64(&stats.RecvMetrics, 1)
+	countUpdate(m.Type, m.Bucket)
+
+	if *debug {
+		logDebug("Received metric for processing", "metric", m)
+	}
+
+	switch m.Type {
+	case Counter:
+		// Increments still held in the -fast-counters shards are merged
+		// first so the reset clears them too
+		if m.Clear && *fastCounters {
+			mergeCounterShards()
+		}
+
+		counters.Lock()
+
+		if _, ok := counters.m[m.Bucket]; overBucketLimit(len(counters.m), ok) {
+			counters.Unlock()
+			break
+		}
+
+		if m.Clear {
+			counters.m[m.Bucket] = 0
+			delete(counters.raw, m.Bucket)
+		}
+
+		counters.m[m.Bucket] += m.CountValue
+
+		if *reportSampleRate {
+			counters.rates[m.Bucket] = m.SampleRate
+		}
+
+		if *emitRawCounts {
+			counters.raw[m.Bucket] += m.RawCount
+		}
+
+		counters.Unlock()
+		atomic.AddUint64(&stats.RecvCounters, 1)
+
+	case Gauge:
+		gauges.Lock()
+
+		if _, ok := gauges.m[m.Bucket]; overBucketLimit(len(gauges.m), ok) {
+			gauges.Unlock()
+			break
+		}
+
+		gauges.m[m.Bucket] = m.Value
+
+		if m.Timestamp != 0 {
+			gauges.times[m.Bucket] = m.Timestamp
+		} else {
+			delete(gauges.times, m.Bucket)
+		}
+
+		if *gaugeAggregation == "avg" {
+			gauges.sum[m.Bucket] += m.Value
+			gauges.count[m.Bucket]++
+		}
+
+		if *gaugeMinMax || *gaugeAggregation == "min" || *gaugeAggregation == "max" {
+			if min, ok := gauges.min[m.Bucket]; !ok || m.Value < min {
+				gauges.min[m.Bucket] = m.Value
+			}
+
+			if max, ok := gauges.max[m.Bucket]; !ok || m.Value > max {
+				gauges.max[m.Bucket] = m.Value
+			}
+		}
+
+		gauges.Unlock()
+		atomic.AddUint64(&stats.RecvGauges, 1)
+
+	case Timer:
+		timers.Lock()
+		_, ok := timers.m[m.Bucket]
+
+		if overBucketLimit(len(timers.m), ok) {
+			timers.Unlock()
+			break
+		}
+
+		if !ok {
+			var t Timers
+			timers.m[m.Bucket] = t
+		}
+
+		// A value sampled at rate r stands for 1/r observations
+		if m.SampleRate > 0 && m.SampleRate < 1 {
+			timers.sampled[m.Bucket] += 1/m.SampleRate - 1
+		}
+
+		if *timerAlgorithm == "tdigest" {
+			d := timers.digests[m.Bucket]
+
+			if d == nil {
+				d = NewTDigest(defaultCompression)
+				timers.digests[m.Bucket] = d
+			}
+
+			d.Add(m.Value)
+		} else {
+			addTimerValue(m.Bucket, m.Value)
+		}
+
+		timers.Unlock()
+		atomic.AddUint64(&stats.RecvTimers, 1)
+
+	case Distribution:
+		distributions.Lock()
+
+		if _, ok := distributions.m[m.Bucket]; overBucketLimit(len(distributions.m), ok) {
+			distributions.Unlock()
+			break
+		}
+
+		distributions.m[m.Bucket] = append(distributions.m[m.Bucket], m.Value)
+		distributions.Unlock()
+		atomic.AddUint64(&stats.RecvDistributions, 1)
+
+	default:
+		if *debug {
+			logDebug("Unable to process unknown metric type", "type", m.Type)
+		}
+
+	}
+
+	if *debug {
+		logDebug("Finished processing metric", "metric", m)
+	}
+}
+
+// dryRunSample is the number of flushed lines logged by -dry-run
+const dryRunSample = 5
+
+// logDryRun logs a summary of a flush that -dry-run kept from being sent
+func logDryRun(b []byte) {
+	lines := strings.SplitAfter(string(b), eol)
+
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	sample := lines
+
+	if len(sample) > dryRunSample {
+		sample = sample[:dryRunSample]
+	}
+
+	for i := range sample {
+		sample[i] = strings.TrimSuffix(sample[i], eol)
+	}
+
+	logInfo("Dry run, not sending metrics", "bytes", len(b), "lines", len(lines),
+		"counters", atomic.LoadUint64(&stats.ActiveCounters),
+		"gauges", atomic.LoadUint64(&stats.ActiveGauges),
+		"timers", atomic.LoadUint64(&stats.ActiveTimers),
+		"distributions", atomic.LoadUint64(&stats.ActiveDistributions),
+		"sample", sample)
+}
+
+// addFastCounter adds a counter token straight to its shard, without
+// allocating a Metric or queueing it for processMetrics. It reports false,
+// leaving the token to the normal path, for anything but a valid counter
+// metric; an error means the token was a counter with an invalid value.
+func addFastCounter(token []byte, prefix string) (bool, error) {
+	p, err := splitMetric(token)
+
+	// Resets are left to processMetric so they apply to the shards too, and
+	// the shards don't keep raw counts
+	if err != nil || metricType(p.typ) != Counter || p.clear || *emitRawCounts {
+		return false, nil
+	}
+
+	val, err := parseCounter(p.value, p.sampleRate)
+
+	if err != nil {
+		return true, err
+	}
+
+	bucket := prefix + p.bucket
+
+	if filterBucket(bucket) {
+		return true, nil
+	}
+
+	countUpdate(Counter, bucket)
+
+	// FNV-1a
+	var h uint32 = 2166136261
+
+	for i := 0; i < len(bucket); i++ {
+		h ^= uint32(bucket[i])
+		h *= 16777619
+	}
+
+	shard := &counterShards[h%counterShardCount]
+	shard.Lock()
+
+	if shard.m == nil {
+		shard.m = make(map[string]fastCounter)
+	}
+
+	c := shard.m[bucket]
+	c.value += val
+	c.updates++
+	c.rate = p.sampleRate
+	shard.m[bucket] = c
+	shard.Unlock()
+
+	atomic.AddUint64(&stats.RecvMetrics, 1)
+	atomic.AddUint64(&stats.RecvCounters, 1)
+	return true, nil
+}
+
+// mergeCounterShards moves the -fast-counters shards into counters. New
+// buckets over -max-buckets are dropped here, and -report-sample-rate
+// records the last rate seen in the shard.
+func mergeCounterShards() {
+	counters.Lock()
+	defer counters.Unlock()
+	mergeCounterShardsLocked()
+}
+
+// mergeCounterShardsLocked is mergeCounterShards for callers that already
+// hold the counters lock
+func mergeCounterShardsLocked() {
+	for i := range counterShards {
+		shard := &counterShards[i]
+		shard.Lock()
+
+		for k, c := range shard.m {
+			if _, ok := counters.m[k]; overBucketLimit(len(counters.m), ok) {
+				// overBucketLimit counted one of the bucket's metrics
+				atomic.AddUint64(&stats.CardinalityDropped, c.updates-1)
+				continue
+			}
+
+			counters.m[k] += c.value
+
+			if *reportSampleRate {
+				counters.rates[k] = c.rate
+			}
+		}
+
+		shard.m = nil
+		shard.Unlock()
+	}
+}
+
+// addTimerValue adds an exact value to a timer, keeping at most
+// -timer-reservoir-size values. Must be called with timers locked.
+func addTimerValue(k string, v float64) {
+	t := timers.m[k]
+
+	if *timerReservoirSize <= 0 || len(t) < *timerReservoirSize {
+		timers.m[k] = append(t, v)
+		return
+	}
+
+	// Reservoir sampling (Vitter's Algorithm R): the nth value replaces a
+	// random sample with probability size/n
+	timers.dropped[k]++
+	seen := int64(len(t)) + timers.dropped[k]
+
+	if i := rand.Int63n(seen); i < int64(len(t)) {
+		t[i] = v
+	}
+}
 
-	atomic.StoreUint64(&stats.RecvCounters, 0)
-	atomic.StoreUint64(&stats.SentCounters, 0)
+// overBucketLimit reports whether a metric must be dropped because its
+// bucket is not one of the n buckets already held for its type and
+// -max-buckets has been reached. Dropped metrics are counted.
+func overBucketLimit(n int, exists bool) bool {
+	if *maxBuckets <= 0 || exists || n < *maxBuckets {
+		return false
+	}
+
+	atomic.AddUint64(&stats.CardinalityDropped, 1)
+	return true
+}
+
+// flushMetrics sends the given flush sections to Graphite. With
+// -split-flush each section is sent on its own as soon as all of them are
+// built, so no single write holds the whole flush.
+func flushMetrics(sections []string) {
+	now := time.Now().Unix()
+
+	if *splitFlush {
+		var push []byte
+
+		for _, buf := range writeSections(now, sections) {
+			if *pushgatewayURL != "" {
+				push = append(push, buf.Bytes()...)
+			}
+
+			if buf.Len() > 0 {
+				sendMetrics(buf, now)
+			}
+
+			bufferPool.Put(buf)
+		}
+
+		pushMetrics(push, now, sections)
+		return
+	}
+
+	buf := getBuffer()
+	defer bufferPool.Put(buf)
+
+	writeMetrics(buf, now, sections)
+	pushMetrics(buf.Bytes(), now, sections)
+	sendMetrics(buf, now)
+}
+
+// pushMetrics sends a flush of the given sections to the Pushgateway in the
+// background. A full flush replaces everything pushed before it for the
+// job, so a flush is never split across pushes.
+func pushMetrics(b []byte, now int64, sections []string) {
+	if *pushgatewayURL == "" || *dryRun {
+		return
+	}
+
+	b = append([]byte(nil), b...)
+	full := len(sections) == len(flushSections)
+	asyncSends.Add(1)
+
+	go func() {
+		defer asyncSends.Done()
+		sendPushgateway(b, now, full)
+	}()
+}
+
+// sendMetrics sends a flush buffer to the backend and the webhook, or just
+// logs it with -dry-run
+func sendMetrics(buf *bytes.Buffer, now int64) {
+	if *dryRun {
+		logDryRun(buf.Bytes())
+		return
+	}
+
+	// Send metrics to the webhook before the buffer is drained by Graphite
+	if *webhookURL != "" {
+		b := append([]byte(nil), buf.Bytes()...)
+		asyncSends.Add(1)
+
+		go func() {
+			defer asyncSends.Done()
+			sendWebhook(b, now)
+		}()
+	}
+
+	switch *backend {
+	case "kafka":
+		sendKafka(kafkaProducer, buf.Bytes(), now)
+	default:
+		sendGraphite(buf)
+	}
+}
+
+// asyncSends tracks the webhook and Pushgateway sends still running in the
+// background
+var asyncSends sync.WaitGroup
+
+// bufferPool holds flush buffers so their memory is reused across flushes
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from bufferPool
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// writeMetrics flushes the given sections to the buffer, with each section
+// written in -flush-order
+func writeMetrics(buf *bytes.Buffer, now int64, due []string) {
+	for _, b := range writeSections(now, due) {
+		b.WriteTo(buf)
+		bufferPool.Put(b)
+	}
+}
+
+// writeSections flushes the given sections to a buffer each and returns them
+// in -flush-order. The buffers are from bufferPool and should be returned to
+// it.
+func writeSections(now int64, due []string) []*bytes.Buffer {
+	var sections = make(map[string]*bytes.Buffer)
+
+	for _, name := range due {
+		sections[name] = getBuffer()
+	}
+
+	mergeCounterShards()
+	countActive()
+
+	if _, ok := sections["counters"]; ok {
+		rollupCounters()
+	}
+
+	if _, ok := sections["timers"]; ok {
+		rollupTimers()
+	}
+
+	// Build buffer of stats. The sent counts add up until the internal
+	// stats are flushed, which may be less often than a type is.
+	for _, t := range []struct {
+		name  string
+		flush func(*bytes.Buffer, int64) uint64
+		sent  *uint64
+	}{
+		{"counters", flushCounters, &stats.SentCounters},
+		{"gauges", flushGauges, &stats.SentGauges},
+		{"timers", flushTimers, &stats.SentTimers},
+		{"distributions", flushDistributions, &stats.SentDistributions},
+	} {
+		if b, ok := sections[t.name]; ok {
+			n := t.flush(b, now)
+			atomic.AddUint64(t.sent, n)
+			atomic.AddUint64(&stats.SentMetrics, n)
+		}
+	}
+
+	logEvent("stats", "Flushed metrics", "sections", due, "stats", stats.Snapshot())
+
+	// Add to internal stats
+	if b, ok := sections["internal"]; ok {
+		logInvalidSources()
+		logTopBuckets()
+		flushInternalStats(b, now)
+	}
+
+	var ordered []*bytes.Buffer
+
+	for _, name := range FlushOrder {
+		if b, ok := sections[name]; ok {
+			ordered = append(ordered, b)
+		}
+	}
+
+	return ordered
+}
+
+// parseFlushOrder parses a comma separated list of flush sections. Sections
+// left out of the list are flushed afterwards in the default order.
+func parseFlushOrder(s string) ([]string, error) {
+	var order []string
+	seen := make(map[string]bool)
+	valid := make(map[string]bool)
+
+	for _, name := range flushSections {
+		valid[name] = true
+	}
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			continue
+		}
+
+		if !valid[name] {
+			return nil, fmt.Errorf("unknown flush section %q", name)
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate flush section %q", name)
+		}
+
+		seen[name] = true
+		order = append(order, name)
+	}
+
+	for _, name := range flushSections {
+		if !seen[name] {
+			order = append(order, name)
+		}
+	}
+
+	return order, nil
+}
+
+// flushInternalStats writes the internal stats to the buffer
+func flushInternalStats(buf *bytes.Buffer, now int64) {
+	// Each stat is read and reset in one operation so increments made during
+	// the flush are carried over to the next interval rather than lost
+	writeInternal(buf, "metrics.sent", atomic.SwapUint64(&stats.SentMetrics, 0), now)
+	writeInternal(buf, "counters.sent", atomic.SwapUint64(&stats.SentCounters, 0), now)
+	writeInternal(buf, "gauges.sent", atomic.SwapUint64(&stats.SentGauges, 0), now)
+	writeInternal(buf, "timers.sent", atomic.SwapUint64(&stats.SentTimers, 0), now)
+	writeInternal(buf, "distributions.sent",
+		atomic.SwapUint64(&stats.SentDistributions, 0), now)
+
+	// Received counts are also reported as a rate. They are reset here, so
+	// they cover the interval of the internal section whatever the interval
+	// of their own type.
+	interval := sectionInterval("internal")
+
+	for _, s := range []struct {
+		name string
+		recv *uint64
+	}{
+		{"metrics", &stats.RecvMetrics},
+		{"counters", &stats.RecvCounters},
+		{"gauges", &stats.RecvGauges},
+		{"timers", &stats.RecvTimers},
+		{"distributions", &stats.RecvDistributions},
+	} {
+		recv := atomic.SwapUint64(s.recv, 0)
+		writeInternal(buf, s.name+".per_second",
+			float64(recv)/interval.Seconds(), now)
+		writeInternal(buf, s.name+".recv", recv, now)
+	}
+
+	writeInternal(buf, "counters.active", atomic.LoadUint64(&stats.ActiveCounters), now)
+	writeInternal(buf, "gauges.active", atomic.LoadUint64(&stats.ActiveGauges), now)
+	writeInternal(buf, "timers.active", atomic.LoadUint64(&stats.ActiveTimers), now)
+	writeInternal(buf, "distributions.active",
+		atomic.LoadUint64(&stats.ActiveDistributions), now)
+	writeInternal(buf, "queue.depth", len(In), now)
+	writeInternal(buf, "queue.dropped", atomic.SwapUint64(&stats.QueueDropped, 0), now)
+
+	// Rejected metrics are counted by cause: parse failures, buckets
+	// dropped by -blocklist or -allowlist, and buckets dropped from a flush
+	// by -relabel-config, beside queue.dropped above
+	writeInternal(buf, "metrics.invalid", atomic.SwapUint64(&stats.InvalidMetrics, 0), now)
+	writeInternal(buf, "metrics.filtered", atomic.SwapUint64(&stats.Filtered, 0), now)
+	writeInternal(buf, "metrics.relabel_dropped",
+		atomic.SwapUint64(&stats.RelabelDropped, 0), now)
+	writeInternal(buf, "bytes.recv.udp", atomic.SwapUint64(&stats.RecvBytesUDP, 0), now)
+	writeInternal(buf, "bytes.recv.tcp", atomic.SwapUint64(&stats.RecvBytesTCP, 0), now)
+	flushPacketSizes(buf, now)
+	writeInternal(buf, "uptime_seconds", now-startTime.Unix(), now)
+
+	// The canary value is the flush time, so the delay until it is stored
+	// downstream is the pipeline latency
+	if *canary {
+		writeInternal(buf, "canary", now, now)
+	}
+
+	atomic.StoreUint64(&stats.RecvMessages, 0)
+}
+
+// countActive records the number of buckets held by each type
+func countActive() {
+	counters.RLock()
+	atomic.StoreUint64(&stats.ActiveCounters, uint64(len(counters.m)))
+	counters.RUnlock()
+
+	gauges.RLock()
+	atomic.StoreUint64(&stats.ActiveGauges, uint64(len(gauges.m)))
+	gauges.RUnlock()
+
+	timers.RLock()
+	atomic.StoreUint64(&stats.ActiveTimers, uint64(len(timers.m)))
+	timers.RUnlock()
+
+	distributions.RLock()
+	atomic.StoreUint64(&stats.ActiveDistributions, uint64(len(distributions.m)))
+	distributions.RUnlock()
+}
+
+// writeInternal writes a single internal stat under -internal-prefix to the
+// buffer, unless it has been left out of -internal-stats or -no-internal-stats
+// is set
+func writeInternal(buf *bytes.Buffer, name string, value interface{}, now int64) {
+	if *noInternalStats || internalStats != nil && !internalStats[name] {
+		return
+	}
+
+	if *internalHostname {
+		fmt.Fprintf(buf, "%s.%s.%s %v %d%s", *internalPrefix, graphiteHostname(*hostname),
+			name, value, now, eol)
+		return
+	}
+
+	fmt.Fprintf(buf, "%s.%s %v %d%s", *internalPrefix, name, value, now, eol)
+}
+
+// defaultHostname returns the host name reported by the kernel, or
+// "unknown" if it can't be read
+func defaultHostname() string {
+	name, err := os.Hostname()
+
+	if err != nil || name == "" {
+		return "unknown"
+	}
+
+	return name
+}
+
+// graphiteHostname makes a host name usable as a single Graphite path
+// node. Dots, which would split it into several nodes, and any other
+// character not valid in a bucket name are replaced by underscores.
+func graphiteHostname(name string) string {
+	b := []byte(name)
+
+	for i, c := range b {
+		if c == '.' || !validBucketChar(c) {
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
+
+// logInvalidSources logs and clears the per-source invalid metric counts
+func logInvalidSources() {
+	invalidSources.Lock()
+	defer invalidSources.Unlock()
+
+	if len(invalidSources.m) == 0 {
+		return
+	}
+
+	logEvent("stats", "Invalid metrics by source", "sources", invalidSources.m)
+	invalidSources.m = make(map[string]uint64)
+}
+
+// flushCounters writes the counters to the buffer. When -delete-counters is
+// false, flushed counters are reset to zero instead of being deleted so idle
+// counters keep emitting 0, until they have been idle for
+// -idle-counter-flushes flushes.
+func flushCounters(buf *bytes.Buffer, now int64) uint64 {
+	counters.Lock()
+	defer counters.Unlock()
+	var n uint64
+	keys := make([]string, 0, len(counters.m))
+
+	for k := range counters.m {
+		keys = append(keys, k)
+	}
+
+	// Counters that were deleted still flush until they leave the window
+	slots := counterWindowSlots()
+
+	for k := range counters.window {
+		if _, ok := counters.m[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	// Counters relabeled to the same name are summed, reporting the lowest
+	// of their sample rates
+	out := make(map[string]counterFlush, len(keys))
+	buckets := make([]string, 0, len(keys))
+
+	for _, k := range keys {
+		v := counters.m[k]
+
+		if slots > 1 {
+			v = addCounterWindow(k, v, slots)
+		}
+
+		if bucket, ok := relabel(k); ok {
+			c, merged := out[bucket]
+
+			if !merged {
+				buckets = append(buckets, bucket)
+			}
+
+			c.value += v
+			c.raw += counters.raw[k]
+
+			if rate, ok := counters.rates[k]; ok && (!c.sampled || rate < c.rate) {
+				c.rate = rate
+				c.sampled = true
+			}
+
+			out[bucket] = c
+		}
+
+		delete(counters.rates, k)
+		delete(counters.raw, k)
+
+		if *deleteCounters || counterExpired(k) {
+			delete(counters.m, k)
+			delete(counters.idle, k)
+		} else {
+			counters.m[k] = 0
+		}
+	}
+
+	if slots > 1 {
+		counters.windowPos = (counters.windowPos + 1) % slots
+	}
+
+	// Write buckets in sorted order so flushes are deterministic
+	sort.Strings(buckets)
+
+	for _, bucket := range buckets {
+		c := out[bucket]
+		writeInt(buf, bucket, "", c.value, now)
+		n++
+
+		if c.sampled {
+			writeFloat(buf, bucket, ".sample_rate", c.rate, -1, now)
+			n++
+		}
+
+		if *emitRawCounts {
+			writeInt(buf, bucket, ".raw", c.raw, now)
+			n++
+		}
+	}
+
+	return n
+}
+
+// counterFlush is a counter as written by a flush, after relabeling
+type counterFlush struct {
+	value   int64
+	raw     int64
+	rate    float64
+	sampled bool
+}
+
+// counterExpired reports whether a counter kept by -delete-counters=false
+// has now been idle for -idle-counter-flushes flushes. Must be called with
+// counters locked, before the counter is reset.
+func counterExpired(k string) bool {
+	if counters.m[k] != 0 {
+		delete(counters.idle, k)
+		return false
+	}
+
+	counters.idle[k]++
+	return *idleCounterFlushes > 0 && counters.idle[k] >= *idleCounterFlushes
+}
+
+// counterWindowSlots returns the number of flushes covered by
+// -counter-window, or 1 if counters aren't windowed
+func counterWindowSlots() int {
+	interval := sectionInterval("counters")
+
+	if *counterWindow <= interval {
+		return 1
+	}
+
+	return int((*counterWindow + interval - 1) / interval)
+}
+
+// addCounterWindow records a counter's delta for this flush in its window
+// and returns the sum over the window. Counters whose window is all zeros
+// are dropped from it. Must be called with counters locked.
+func addCounterWindow(k string, delta int64, slots int) int64 {
+	ring := counters.window[k]
+
+	if len(ring) != slots {
+		ring = make([]int64, slots)
+		counters.window[k] = ring
+	}
+
+	ring[counters.windowPos%slots] = delta
+	var sum int64
+	empty := true
+
+	for _, v := range ring {
+		sum += v
+		empty = empty && v == 0
+	}
+
+	if empty {
+		delete(counters.window, k)
+	}
+
+	return sum
+}
+
+// flushGauges writes the gauges to the buffer. Gauges keep their last value
+// across flushes unless -delete-gauges is set.
+func flushGauges(buf *bytes.Buffer, now int64) uint64 {
+	gauges.Lock()
+	defer gauges.Unlock()
+	var n uint64
+	keys := make([]string, 0, len(gauges.m))
+
+	for k := range gauges.m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	seen := make(map[string]bool, len(keys))
 
-	atomic.StoreUint64(&stats.RecvGauges, 0)
-	atomic.StoreUint64(&stats.SentGauges, 0)
+	for _, k := range keys {
+		// An idle gauge repeats the aggregate of the last interval it was
+		// set in
+		gauges.m[k] = aggregateGauge(k)
+
+		// A gauge set to 0 is a real value and is written like any other;
+		// only gauges that were never sent (or were deleted) are absent.
+		// Adding 0 turns -0 into 0 so it isn't written as "-0".
+		v := gauges.m[k]*(*gaugeMultiplier) + 0
+		ts := now
+
+		// A backdated gauge keeps its timestamp until it is set again
+		if t, ok := gauges.times[k]; ok {
+			ts = t
+		}
+
+		if bucket, ok := relabelUnique(seen, k); ok {
+			writeFloat(buf, bucket, "", v, -1, ts)
+			n++
+
+			// A gauge that wasn't set this interval held its last value
+			if *gaugeMinMax {
+				min, max := v, v
+
+				if _, ok := gauges.min[k]; ok {
+					min = gauges.min[k]*(*gaugeMultiplier) + 0
+					max = gauges.max[k]*(*gaugeMultiplier) + 0
+				}
+
+				// A negative multiplier swaps the ends of the range
+				if min > max {
+					min, max = max, min
+				}
+
+				writeFloat(buf, bucket, ".min", min, -1, ts)
+				writeFloat(buf, bucket, ".max", max, -1, ts)
+				n += 2
+			}
+		}
+
+		delete(gauges.min, k)
+		delete(gauges.max, k)
+		delete(gauges.sum, k)
+		delete(gauges.count, k)
+
+		if *deleteGauges {
+			delete(gauges.m, k)
+			delete(gauges.times, k)
+		}
+	}
+
+	return n
+}
+
+// aggregateGauge returns the -gauge-aggregation of the values a gauge was
+// set to this interval, or its last value if it wasn't set. Must be called
+// with gauges locked.
+func aggregateGauge(k string) float64 {
+	switch *gaugeAggregation {
+	case "avg":
+		if n := gauges.count[k]; n > 0 {
+			return gauges.sum[k] / float64(n)
+		}
+	case "min":
+		if min, ok := gauges.min[k]; ok {
+			return min
+		}
+	case "max":
+		if max, ok := gauges.max[k]; ok {
+			return max
+		}
+	}
+
+	return gauges.m[k]
+}
+
+// flushTimers writes the timers and aggregate statistics to the buffer
+func flushTimers(buf *bytes.Buffer, now int64) uint64 {
+	timers.Lock()
+	defer timers.Unlock()
+	var n uint64
+	keys := make([]string, 0, len(timers.m))
+
+	for k := range timers.m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	pcts := Percentiles()
+	names := timerNames{
+		perc:  percentileNames("."+*percentileSuffix, pcts),
+		mean:  percentileNames(".mean_", pcts),
+		upper: percentileNames(".upper_", pcts),
+	}
+	seen := make(map[string]bool, len(keys))
+
+	for _, k := range keys {
+		t := timers.m[k]
+		d := timers.digests[k]
+		count := len(t) + int(timers.dropped[k]) + int(math.Floor(timers.sampled[k]+0.5))
+
+		if d != nil {
+			count += int(d.Count())
+		}
+
+		bucket, ok := relabelUnique(seen, k)
+
+		if !ok {
+			resetTimer(k, false)
+			continue
+		}
+
+		// Timers kept by -delete-timers=false only report their count
+		// while idle
+		if count < 1 && !*deleteTimers {
+			writeInt(buf, bucket, ".count", 0, now)
+			writeFloat(buf, bucket, ".count_ps", 0, -1, now)
+			n += 2
+			continue
+		}
+
+		// A bucket can be created without any values, and the lower and
+		// upper bounds can't be taken from an empty list
+		if count < 1 || d == nil && len(t) == 0 {
+			resetTimer(k, !*deleteTimers)
+			continue
+		}
+
+		if d != nil {
+			writeDigestTimer(buf, bucket, d, count, pcts, names, now)
+		} else {
+			writeExactTimer(buf, bucket, t, count, pcts, names, now)
+		}
+
+		resetTimer(k, !*deleteTimers)
+		n += (5 + 3*uint64(len(pcts)))
+	}
+
+	return n
+}
+
+// resetTimer clears a timer's values after a flush, deleting its bucket
+// unless keep is set. Must be called with timers locked.
+func resetTimer(k string, keep bool) {
+	delete(timers.dropped, k)
+	delete(timers.sampled, k)
+	delete(timers.digests, k)
+
+	if keep {
+		timers.m[k] = nil
+	} else {
+		delete(timers.m, k)
+	}
+}
+
+// timerNames holds the bucket suffixes of each timer percentile
+type timerNames struct {
+	perc  []string
+	mean  []string
+	upper []string
+}
+
+// writeExactTimer writes a timer's stats computed from all of its values
+func writeExactTimer(buf *bytes.Buffer, bucket string, t Timers, count int,
+	pcts []float64, names timerNames, now int64) {
+	var sum float64
+
+	for _, v := range t {
+		sum += v
+	}
 
-	atomic.StoreUint64(&stats.RecvTimers, 0)
-	atomic.StoreUint64(&stats.SentTimers, 0)
+	// Linear average (mean)
+	scale := *timerMultiplier
+	prec := floatPrecision()
+	mean := float64(sum) / float64(len(t)) * scale
+
+	// Min and Max
+	sort.Sort(t)
+	min := t[0] * scale
+	max := t[len(t)-1] * scale
+
+	// Write out all derived stats
+	writeInt(buf, bucket, ".count", int64(count), now)
+	writeFloat(buf, bucket, ".count_ps",
+		float64(count)/sectionInterval("timers").Seconds(), -1, now)
+	writeFloat(buf, bucket, ".mean", mean, prec, now)
+	writeFloat(buf, bucket, ".lower", min, prec, now)
+	writeFloat(buf, bucket, ".upper", max, prec, now)
+
+	// Calculate and write out percentiles, plus the mean and max of the
+	// values within each percentile threshold
+	for j, pct := range pcts {
+		i := percIndex(len(t), pct)
+		var pctSum float64
+
+		for _, v := range t[:i+1] {
+			pctSum += v
+		}
 
+		writeFloat(buf, bucket, names.perc[j], t[i]*scale, prec, now)
+		writeFloat(buf, bucket, names.mean[j], pctSum/float64(i+1)*scale, prec, now)
+		writeFloat(buf, bucket, names.upper[j], t[i]*scale, prec, now)
+	}
 }
 
-// flushCounters writes the counters to the buffer
-func flushCounters(buf *bytes.Buffer, now int64) uint64 {
-	counters.Lock()
-	defer counters.Unlock()
-	var n uint64
-
-	for k, v := range counters.m {
-		fmt.Fprintln(buf, k, v, now)
-		delete(counters.m, k)
-		n++
+// writeDigestTimer writes a timer's stats estimated by its t-digest
+func writeDigestTimer(buf *bytes.Buffer, bucket string, d *TDigest, count int,
+	pcts []float64, names timerNames, now int64) {
+	scale := *timerMultiplier
+	prec := floatPrecision()
+
+	writeInt(buf, bucket, ".count", int64(count), now)
+	writeFloat(buf, bucket, ".count_ps",
+		float64(count)/sectionInterval("timers").Seconds(), -1, now)
+	writeFloat(buf, bucket, ".mean", d.Mean()*scale, prec, now)
+	writeFloat(buf, bucket, ".lower", d.Min()*scale, prec, now)
+	writeFloat(buf, bucket, ".upper", d.Max()*scale, prec, now)
+
+	for j, pct := range pcts {
+		v := d.Quantile(pct/100) * scale
+		writeFloat(buf, bucket, names.perc[j], v, prec, now)
+		writeFloat(buf, bucket, names.mean[j], d.TrimmedMean(pct/100)*scale, prec, now)
+		writeFloat(buf, bucket, names.upper[j], v, prec, now)
 	}
-
-	return n
 }
 
-// flushGauges writes the gauges to the buffer
-func flushGauges(buf *bytes.Buffer, now int64) uint64 {
-	gauges.Lock()
-	defer gauges.Unlock()
+// flushDistributions writes the distribution count, average and percentiles
+// to the buffer
+func flushDistributions(buf *bytes.Buffer, now int64) uint64 {
+	distributions.Lock()
+	defer distributions.Unlock()
 	var n uint64
+	keys := make([]string, 0, len(distributions.m))
 
-	for k, v := range gauges.m {
-		fmt.Fprintln(buf, k, v, now)
-		delete(gauges.m, k)
-		n++
+	for k := range distributions.m {
+		keys = append(keys, k)
 	}
 
-	return n
-}
-
-// flushTimers writes the timers and aggregate statistics to the buffer
-func flushTimers(buf *bytes.Buffer, now int64) uint64 {
-	timers.RLock()
-	defer timers.RUnlock()
-	var n uint64
+	sort.Strings(keys)
+	pcts := Percentiles()
+	names := percentileNames(".distribution."+*percentileSuffix, pcts)
+	seen := make(map[string]bool, len(keys))
 
-	for k, t := range timers.m {
+	for _, k := range keys {
+		t := distributions.m[k]
 		count := len(t)
+		bucket, ok := relabelUnique(seen, k)
 
-		// Skip processing if there are no timer values
-		if count < 1 {
-			break
+		if !ok {
+			delete(distributions.m, k)
+			continue
 		}
 
 		var sum float64
@@ -483,73 +2516,290 @@ func flushTimers(buf *bytes.Buffer, now int64) uint64 {
 			sum += v
 		}
 
-		// Linear average (mean)
-		mean := float64(sum) / float64(count)
-
-		// Min and Max
 		sort.Sort(t)
-		min := t[0]
-		max := t[len(t)-1]
+		scale := *distributionMultiplier
+		prec := floatPrecision()
 
-		// Write out all derived stats
-		fmt.Fprintf(buf, "%s.count %d %d\n", k, count, now)
-		fmt.Fprintf(buf, "%s.mean %f %d\n", k, mean, now)
-		fmt.Fprintf(buf, "%s.lower %f %d\n", k, min, now)
-		fmt.Fprintf(buf, "%s.upper %f %d\n", k, max, now)
+		writeInt(buf, bucket, ".distribution.count", int64(count), now)
+		writeFloat(buf, bucket, ".distribution.avg", sum/float64(count)*scale, prec, now)
 
-		// Calculate and write out percentiles
-		for _, pct := range Percentiles {
-			p := perc(t, pct)
-			fmt.Fprintf(buf, "%s.perc%d %f %d\n", k, pct, p, now)
+		for j, pct := range pcts {
+			writeFloat(buf, bucket, names[j], perc(t, pct)*scale, prec, now)
 		}
 
-		delete(timers.m, k)
-		n += (4 + uint64(len(Percentiles)))
+		delete(distributions.m, k)
+		n += 2 + uint64(len(pcts))
 	}
 
 	return n
 }
 
-// percentile calculates Nth percentile of a list of values
-func perc(values []float64, pct int) float64 {
-	p := float64(pct) / float64(100)
-	n := float64(len(values))
-	i := math.Ceil(p*n) - 1
+// percentileNames returns the bucket suffix of each percentile, e.g.
+// .perc95 for the prefix ".perc"
+func percentileNames(prefix string, pcts []float64) []string {
+	names := make([]string, len(pcts))
+
+	for i, pct := range pcts {
+		names[i] = prefix + percName(pct)
+	}
+
+	return names
+}
+
+// writeInt writes a "<bucket><suffix> <value> <now>" line with an integer
+// value to the buffer
+func writeInt(buf *bytes.Buffer, bucket, suffix string, v, now int64) {
+	var scratch [32]byte
+
+	buf.WriteString(bucket)
+	buf.WriteString(suffix)
+	buf.WriteByte(' ')
+	buf.Write(strconv.AppendInt(scratch[:0], v, 10))
+	buf.WriteByte(' ')
+	buf.Write(strconv.AppendInt(scratch[:0], now, 10))
+	buf.WriteString(eol)
+}
+
+// floatPrecision returns the precision timer and distribution values are
+// written with: -value-precision places, or the shortest exact form with
+// -compact-floats
+func floatPrecision() int {
+	if *compactFloats {
+		return -1
+	}
+
+	return *valuePrecision
+}
+
+// writeFloat writes a "<bucket><suffix> <value> <now>" line to the buffer.
+// The value has prec decimal places, or the fewest digits that represent it
+// exactly (like %v) if prec is negative.
+func writeFloat(buf *bytes.Buffer, bucket, suffix string, v float64, prec int, now int64) {
+	var scratch [64]byte
+	format := byte('f')
+
+	if prec < 0 {
+		format = 'g'
+	}
+
+	buf.WriteString(bucket)
+	buf.WriteString(suffix)
+	buf.WriteByte(' ')
+	buf.Write(strconv.AppendFloat(scratch[:0], v, format, prec, 64))
+	buf.WriteByte(' ')
+	buf.Write(strconv.AppendInt(scratch[:0], now, 10))
+	buf.WriteString(eol)
+}
+
+// percentile calculates Nth percentile of a sorted, non-empty list of values
+// using the nearest-rank method
+func perc(values []float64, pct float64) float64 {
+	return values[percIndex(len(values), pct)]
+}
+
+// percIndex returns the index of the Nth percentile in a sorted list of n
+// values
+func percIndex(n int, pct float64) int {
+	i := int(math.Ceil(pct*float64(n)/100)) - 1
+
+	// Clamp the rank so extreme percentiles on tiny samples (e.g. p99.9 of a
+	// single value, or p0) still land on a value
+	if i < 0 {
+		i = 0
+	} else if i > n-1 {
+		i = n - 1
+	}
+
+	return i
+}
+
+// percName formats a percentile for use in a metric name, e.g. 99.9 -> 99_9
+func percName(pct float64) string {
+	s := strconv.FormatFloat(pct, 'f', -1, 64)
+	return strings.Replace(s, ".", "_", -1)
+}
 
-	return values[int(i)]
+// parsePercentiles parses a comma separated list of percentiles
+func parsePercentiles(s string) ([]float64, error) {
+	var pcts []float64
+
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+
+		if f == "" {
+			continue
+		}
+
+		pct, err := strconv.ParseFloat(f, 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("percentile %q out of range", f)
+		}
+
+		pcts = append(pcts, pct)
+	}
+
+	return pcts, nil
 }
 
-// sendGraphite sends metrics to graphite
+// sendGraphite sends metrics to graphite. With -max-queue-bytes or
+// -spill-dir, a flush that can't be sent is queued and resent with the next.
 func sendGraphite(buf *bytes.Buffer) {
-	log.Printf("Sending metrics to Graphite: bytes=%d host=%s",
-		buf.Len(), *graphite)
+	if queueGraphite() {
+		graphiteQueue.send(buf.Bytes(), sendGraphiteBytes)
+		return
+	}
+
+	sendGraphiteBytes(buf.Bytes())
+}
+
+// sendGraphiteBytes sends a single flush to Graphite
+func sendGraphiteBytes(b []byte) error {
+	buf := bytes.NewBuffer(b)
+	logInfo("Sending metrics to Graphite", "bytes", buf.Len(),
+		"host", *graphite)
 	t0 := time.Now()
 
-	conn, err := net.Dial("tcp", *graphite)
+	conn, err := dialGraphite()
 
 	if err != nil {
-		log.Printf("ERROR: Unable to connect to graphite: %s", err)
-		return
+		logError("Unable to connect to graphite", "host", *graphite,
+			"error", err)
+		return err
+	}
+
+	var n int64
+
+	// Don't let a Graphite that stops reading block every later flush
+	if *graphiteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(*graphiteTimeout))
 	}
 
-	w := bufio.NewWriter(conn)
-	n, err := buf.WriteTo(w)
+	if *graphiteUDP {
+		n, err = writeDatagrams(conn, buf.Bytes(), maxDatagramSize)
+	} else {
+		n, err = writeGraphite(conn, buf)
+	}
 
 	if err != nil {
-		log.Printf("ERROR: Unable to write to graphite: %s", err)
+		logError("Unable to write to graphite", "host", *graphite,
+			"error", err)
 	}
 
-	w.Flush()
 	conn.Close()
 
-	log.Printf("Finished sending metrics to Graphite: bytes=%d host=%s duration=%s",
-		n, conn.RemoteAddr(), time.Now().Sub(t0))
+	logInfo("Finished sending metrics to Graphite", "bytes", n,
+		"host", conn.RemoteAddr(), "duration", time.Now().Sub(t0))
+	return err
+}
+
+// writeGraphite writes a flush to a Graphite TCP connection, compressed
+// with -graphite-compress. A gzip stream starts with the 1f 8b magic bytes,
+// which is how relays that accept both tell it from plaintext.
+func writeGraphite(conn io.Writer, buf *bytes.Buffer) (int64, error) {
+	bw := bufio.NewWriter(conn)
+
+	if !*graphiteCompress {
+		n, err := buf.WriteTo(bw)
+
+		if err != nil {
+			return n, err
+		}
+
+		return n, bw.Flush()
+	}
+
+	zw := gzip.NewWriter(bw)
+	n, err := buf.WriteTo(zw)
+
+	if err != nil {
+		return n, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return n, err
+	}
+
+	return n, bw.Flush()
+}
+
+// maxDatagramSize keeps -graphite-udp datagrams within a 1500 byte MTU
+const maxDatagramSize = 1400
+
+// writeDatagrams writes the lines in buf to w in datagrams of at most size
+// bytes. Lines are never split, so a line longer than size is sent alone.
+func writeDatagrams(w io.Writer, buf []byte, size int) (int64, error) {
+	var n int64
+
+	for len(buf) > 0 {
+		end := 0
+
+		// Take as many whole lines as fit
+		for end < len(buf) {
+			i := bytes.IndexByte(buf[end:], '\n')
+			next := len(buf)
+
+			if i > -1 {
+				next = end + i + 1
+			}
+
+			if end > 0 && next > size {
+				break
+			}
+
+			end = next
+		}
+
+		written, err := w.Write(buf[:end])
+		n += int64(written)
+
+		if err != nil {
+			return n, err
+		}
+
+		buf = buf[end:]
+	}
+
+	return n, nil
+}
+
+// dialGraphite connects to Graphite, using UDP if -graphite-udp is set or
+// TLS if -graphite-tls is set
+func dialGraphite() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: *graphiteTimeout}
+
+	if *graphiteUDP {
+		return dialer.Dial("udp", *graphite)
+	}
+
+	if *graphiteTLS {
+		return tls.DialWithDialer(dialer, "tcp", *graphite, &tls.Config{
+			InsecureSkipVerify: *graphiteTLSSkipVerify,
+		})
+	}
+
+	return dialer.Dial("tcp", *graphite)
 }
 
 //-----------------------------------------------------------------------------
 
 func main() {
 	flag.Parse()
+	cmdlineFlags = setFlags(flag.CommandLine)
+
+	if *configFile != "" {
+		if err := loadConfigFile(flag.CommandLine, *configFile, cmdlineFlags); err != nil {
+			logFatal("Unable to load config", "path", *configFile, "error", err)
+		}
+	}
+
+	if err := setupLogging(*logFormat); err != nil {
+		logFatal("Invalid -log-format: must be text or json", "value", *logFormat)
+	}
 
 	// Profiling
 	if *cpuprofile || *memprofile || *blockprofile {
@@ -564,22 +2814,283 @@ func main() {
 		defer p.Stop()
 	}
 
+	switch *lineEnding {
+	case "lf":
+		eol = "\n"
+	case "crlf":
+		eol = "\r\n"
+	default:
+		logFatal("Invalid -line-ending: must be lf or crlf", "value", *lineEnding)
+	}
+
+	if *internalStatsList != "" {
+		internalStats = make(map[string]bool)
+
+		for _, name := range strings.Split(*internalStatsList, ",") {
+			internalStats[strings.TrimSpace(name)] = true
+		}
+	}
+
+	if *counterRounding != "truncate" && *counterRounding != "round" {
+		logFatal("Invalid -counter-rounding: must be truncate or round",
+			"value", *counterRounding)
+	}
+
+	switch *gaugeAggregation {
+	case "last", "avg", "min", "max":
+	default:
+		logFatal("Invalid -gauge-aggregation: must be last, avg, min or max",
+			"value", *gaugeAggregation)
+	}
+
+	if *longNamePolicy != "reject" && *longNamePolicy != "truncate" {
+		logFatal("Invalid -long-name-policy: must be reject or truncate",
+			"value", *longNamePolicy)
+	}
+
+	if err := checkTLSFlags(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+		logFatal("Invalid TLS flags", "error", err)
+	}
+
+	if *graphiteUDP && *graphiteTLS {
+		logFatal("-graphite-udp and -graphite-tls can't be used together")
+	}
+
+	if *graphiteUDP && *graphiteCompress {
+		logFatal("-graphite-udp and -graphite-compress can't be used together")
+	}
+
+	aliases, err := parseTypeAliases(*typeAliasList)
+
+	if err != nil {
+		logFatal("Invalid -type-aliases", "error", err)
+	}
+
+	typeAliases = aliases
+
+	if _, ok := timerUnits[*timerUnit]; !ok {
+		logFatal("Invalid -timer-unit: must be ns, us, ms or s", "value", *timerUnit)
+	}
+
+	if *timerAlgorithm != "exact" && *timerAlgorithm != "tdigest" {
+		logFatal("Invalid -timer-algorithm: must be exact or tdigest",
+			"value", *timerAlgorithm)
+	}
+
+	if *valuePrecision < 0 {
+		logFatal("Invalid -value-precision: must not be negative", "value", *valuePrecision)
+	}
+
+	if *flushInterval <= 0 {
+		logFatal("Invalid -flush-interval: must be positive", "value", *flushInterval)
+	}
+
+	for name, d := range map[string]time.Duration{
+		"counter-flush-interval": *counterFlushInterval,
+		"gauge-flush-interval":   *gaugeFlushInterval,
+		"timer-flush-interval":   *timerFlushInterval,
+	} {
+		if d < 0 {
+			logFatal("Invalid -"+name+": must not be negative", "value", d)
+		}
+	}
+
+	FlushJitter, err = parseFlushJitter(*flushJitter, *flushInterval)
+
+	if err != nil {
+		logFatal("Invalid -flush-jitter", "error", err)
+	}
+
+	if *maxConnections > 0 {
+		connSlots = make(chan struct{}, *maxConnections)
+	}
+
+	if *maxLineLength < 1 {
+		logFatal("Invalid -max-line-length: must be at least 1", "value", *maxLineLength)
+	}
+
+	if *queueSize < 1 {
+		logFatal("Invalid -queue-size: must be at least 1", "value", *queueSize)
+	}
+
+	In = make(chan *Metric, *queueSize)
+
+	if *maxRatePerIP > 0 {
+		limiter = NewRateLimiter(*maxRatePerIP)
+	}
+
+	order, err := parseFlushOrder(*flushOrder)
+
+	if err != nil {
+		logFatal("Invalid -flush-order", "error", err)
+	}
+
+	FlushOrder = order
+
+	listeners, err := parseListenAddrs(*listen)
+
+	if err != nil {
+		logFatal("Invalid -listen", "error", err)
+	}
+
+	named, err := parseListeners(*namedListeners)
+
+	if err != nil {
+		logFatal("Invalid -listeners", "error", err)
+	}
+
+	listeners = append(listeners, named...)
+
+	if len(listeners) == 0 {
+		logFatal("No listeners: set -listen or -listeners")
+	}
+
+	if err := applyRuntimeConfig(*percentiles, *renameRules); err != nil {
+		logFatal(err.Error())
+	}
+
+	watchReload()
+
+	if *blocklist != "" {
+		bucketBlocklist, err = loadBucketFilter(*blocklist)
+
+		if err != nil {
+			logFatal("Unable to load -blocklist", "path", *blocklist, "error", err)
+		}
+	}
+
+	if *allowlist != "" {
+		bucketAllowlist, err = loadBucketFilter(*allowlist)
+
+		if err != nil {
+			logFatal("Unable to load -allowlist", "path", *allowlist, "error", err)
+		}
+	}
+
+	if *relabelConfig != "" {
+		relabels, err = loadRelabelRules(*relabelConfig)
+
+		if err != nil {
+			logFatal(err.Error())
+		}
+	}
+
+	if *rollupRules != "" {
+		rollups, err = loadRollupRules(*rollupRules)
+
+		if err != nil {
+			logFatal(err.Error())
+		}
+	}
+
+	if *webhookTemplate != "" {
+		if err := loadWebhookTemplate(*webhookTemplate); err != nil {
+			logFatal(err.Error())
+		}
+	}
+
+	if *verifyFile != "" {
+		if err := runVerify(*verifyFile, *verifyOut); err != nil {
+			logFatal(err.Error())
+		}
+
+		return
+	}
+
+	switch *backend {
+	case "graphite":
+	case "kafka":
+		kafkaProducer, err = newKafkaProducer(strings.Split(*kafkaBrokers, ","))
+
+		if err != nil {
+			logFatal("Unable to connect to Kafka", "brokers", *kafkaBrokers,
+				"error", err)
+		}
+	default:
+		logFatal("Invalid -backend: must be graphite or kafka", "value", *backend)
+	}
+
+	if *stdin {
+		if err := runStdin(os.Stdin); err != nil {
+			logFatal("Unable to read from stdin", "error", err)
+		}
+
+		return
+	}
+
+	if *replayFile != "" {
+		f, err := os.Open(*replayFile)
+
+		if err != nil {
+			logFatal("Unable to open replay file", "path", *replayFile, "error", err)
+		}
+
+		if err := runReplay(f); err != nil {
+			logFatal("Unable to replay", "path", *replayFile, "error", err)
+		}
+
+		f.Close()
+		return
+	}
+
+	if *spillDir != "" {
+		if err := graphiteQueue.loadSpill(*spillDir); err != nil {
+			logFatal("Unable to load -spill-dir", "path", *spillDir, "error", err)
+		}
+	}
+
+	// Restore metrics saved at the last shutdown and save them again at the
+	// next one
+	if *walPath != "" {
+		if err := loadSnapshot(*walPath); err != nil {
+			logFatal("Unable to load snapshot", "path", *walPath, "error", err)
+		}
+
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+			<-sig
+
+			if err := saveSnapshot(*walPath); err != nil {
+				logFatal("Unable to save snapshot", "path", *walPath,
+					"error", err)
+			}
+
+			logInfo("Saved snapshot", "path", *walPath)
+			os.Exit(0)
+		}()
+	}
+
 	// Process metrics as they arrive
 	go processMetrics()
 
-	// Setup listeners
-	var wg sync.WaitGroup
-	wg.Add(2)
+	if *httpAddr != "" {
+		go func() {
+			logFatal(ListenHTTP(*httpAddr).Error())
+		}()
+	}
 
-	go func() {
-		defer wg.Done()
-		log.Fatal(ListenUDP(*listen))
-	}()
+	if *mgmtAddr != "" {
+		go func() {
+			logFatal(ListenMgmt(*mgmtAddr).Error())
+		}()
+	}
 
-	go func() {
-		defer wg.Done()
-		log.Fatal(ListenTCP(*listen))
-	}()
+	// Setup listeners
+	var wg sync.WaitGroup
+	wg.Add(2 * len(listeners))
+
+	for _, l := range listeners {
+		go func(l NamedListener) {
+			defer wg.Done()
+			logFatal(ListenUDP(l.Addr, l.Prefix()).Error())
+		}(l)
+
+		go func(l NamedListener) {
+			defer wg.Done()
+			logFatal(ListenTCP(l.Addr, l.Prefix()).Error())
+		}(l)
+	}
 
 	wg.Wait()
 }
@@ -2,11 +2,21 @@ package main
 
 import (
 	"bytes"
-	//"fmt"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
 	"reflect"
 	"regexp"
-	//"sync"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type metricTest struct {
@@ -15,15 +25,247 @@ type metricTest struct {
 }
 
 var metricTests = []metricTest{
-	{"mycounter:1|c", &Metric{Bucket: "mycounter", Value: int64(1), Type: Counter}},
-	{"mycounter:1|c\n", &Metric{Bucket: "mycounter", Value: int64(1), Type: Counter}},
-	{"  mycounter:1|c ", &Metric{Bucket: "mycounter", Value: int64(1), Type: Counter}},
+	{"mycounter:1|c", &Metric{Bucket: "mycounter", CountValue: 1, Type: Counter}},
+	{"mycounter:1|c\n", &Metric{Bucket: "mycounter", CountValue: 1, Type: Counter}},
+	{"  mycounter:1|c ", &Metric{Bucket: "mycounter", CountValue: 1, Type: Counter}},
 
-	{"mygauge:78|g", &Metric{Bucket: "mygauge", Value: float64(78), Type: Gauge}},
-	{"mygauge:8.9|g", &Metric{Bucket: "mygauge", Value: float64(8.9), Type: Gauge}},
+	{"mygauge:78|g", &Metric{Bucket: "mygauge", Value: 78, Type: Gauge}},
+	{"mygauge:8.9|g", &Metric{Bucket: "mygauge", Value: 8.9, Type: Gauge}},
 
-	{"mytimer:123|ms", &Metric{Bucket: "mytimer", Value: float64(123), Type: Timer}},
-	{"mytimer:0.789|ms", &Metric{Bucket: "mytimer", Value: float64(0.789), Type: Timer}},
+	{"mytimer:123|ms", &Metric{Bucket: "mytimer", Value: 123, Type: Timer}},
+	{"mytimer:0.789|ms", &Metric{Bucket: "mytimer", Value: 0.789, Type: Timer}},
+	{"mytimer:1.5|ms|u:s", &Metric{Bucket: "mytimer", Value: 1500, Type: Timer}},
+
+	{"mydist:42|d", &Metric{Bucket: "mydist", Value: 42, Type: Distribution}},
+
+	{"gorets:1|c|@0.1", &Metric{Bucket: "gorets", CountValue: 10, Type: Counter}},
+	{"gorets:1|@0.1|c", &Metric{Bucket: "gorets", CountValue: 10, Type: Counter}},
+	{"gorets:1|c|@0.5", &Metric{Bucket: "gorets", CountValue: 2, Type: Counter}},
+	{"gorets:1|c|@1e-2", &Metric{Bucket: "gorets", CountValue: 100, Type: Counter}},
+	{"gorets:1|@1e-2|c", &Metric{Bucket: "gorets", CountValue: 100, Type: Counter}},
+	{"gorets:3|c|@2.5E-1", &Metric{Bucket: "gorets", CountValue: 12, Type: Counter}},
+	{"gorets:7|c|@7e-2", &Metric{Bucket: "gorets", CountValue: 100, Type: Counter}},
+	{"gorets:1|c|@1e0", &Metric{Bucket: "gorets", CountValue: 1, Type: Counter}},
+	{"gorets:1|c|@1e1%", &Metric{Bucket: "gorets", CountValue: 10, Type: Counter}},
+	{"gorets:1|c|@50%", &Metric{Bucket: "gorets", CountValue: 2, Type: Counter}},
+	{"gorets:1|c|@100%", &Metric{Bucket: "gorets", CountValue: 1, Type: Counter}},
+	{"mytimer:1.5|@0.5|u:s|ms", &Metric{Bucket: "mytimer", Value: 1500, Type: Timer}},
+
+	{"mygauge:3|g|T1700000000", &Metric{Bucket: "mygauge", Value: 3, Type: Gauge, Timestamp: 1700000000}},
+	{"gorets:1|T1700000000|c", &Metric{Bucket: "gorets", CountValue: 1, Type: Counter, Timestamp: 1700000000}},
+}
+
+func TestParseMetricBucketValidation(t *testing.T) {
+	defer func(b bool) { *sanitize = b }(*sanitize)
+
+	tests := []struct {
+		input     string
+		sanitized string
+	}{
+		{"my counter:1|c", "my_counter"},
+		{"my\tcounter:1|c", "my_counter"},
+		{"my/counter!:1|c", "my_counter_"},
+		{"my\x00counter:1|c", "my_counter"},
+	}
+
+	for _, tt := range tests {
+		*sanitize = false
+
+		if _, err := parseMetric([]byte(tt.input)); err == nil {
+			t.Errorf("parseMetric(%q): expected error", tt.input)
+		}
+
+		*sanitize = true
+		m, err := parseMetric([]byte(tt.input))
+
+		if err != nil {
+			t.Errorf("parseMetric(%q) with -sanitize: %s", tt.input, err)
+			continue
+		}
+
+		if m.Bucket != tt.sanitized {
+			t.Errorf("parseMetric(%q) with -sanitize: got %q, want %q",
+				tt.input, m.Bucket, tt.sanitized)
+		}
+	}
+
+	*sanitize = false
+
+	if m, err := parseMetric([]byte("My-counter_1.x:1|c")); err != nil {
+		t.Error(err)
+	} else if m.Bucket != "My-counter_1.x" {
+		t.Errorf("parseMetric: got %q, want %q", m.Bucket, "My-counter_1.x")
+	}
+
+	if _, err := parseMetric([]byte(":1|c")); err == nil {
+		t.Error("parseMetric(\":1|c\"): expected error for empty bucket")
+	}
+}
+
+func TestParseMetricNegativeCounter(t *testing.T) {
+	defer func(b bool) { *allowNegativeCounters = b }(*allowNegativeCounters)
+
+	*allowNegativeCounters = true
+	m, err := parseMetric([]byte("mycounter:-5|c"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.CountValue != -5 {
+		t.Errorf("parseMetric: got %v, want -5", m.CountValue)
+	}
+
+	*allowNegativeCounters = false
+
+	if _, err := parseMetric([]byte("mycounter:-5|c")); err == nil {
+		t.Error("parseMetric: expected error for negative counter")
+	}
+
+	before := atomic.LoadUint64(&stats.InvalidMetrics)
+	handleMessage([]byte("mycounter:-5|c"), nil, "")
+
+	if got := atomic.LoadUint64(&stats.InvalidMetrics) - before; got != 1 {
+		t.Errorf("InvalidMetrics: got %d new, want 1", got)
+	}
+
+	// Negative gauges are unaffected
+	if _, err := parseMetric([]byte("mygauge:-5|g")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseMetricCounterRounding(t *testing.T) {
+	defer func(s string) { *counterRounding = s }(*counterRounding)
+
+	tests := []struct {
+		policy string
+		input  string
+		want   int64
+	}{
+		{"truncate", "c:1|c|@0.3", 3},
+		{"round", "c:1|c|@0.3", 3},
+		{"truncate", "c:2|c|@0.3", 6},
+		{"round", "c:2|c|@0.3", 7},
+		{"truncate", "c:-2|c|@0.3", -6},
+		{"round", "c:-2|c|@0.3", -7},
+		{"truncate", "c:7|c|@7e-2", 100},
+		{"truncate", "c:-7|c|@0.07", -100},
+	}
+
+	for _, tt := range tests {
+		*counterRounding = tt.policy
+		m, err := parseMetric([]byte(tt.input))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.CountValue != tt.want {
+			t.Errorf("parseMetric(%q) with %s: got %v, want %d",
+				tt.input, tt.policy, m.CountValue, tt.want)
+		}
+	}
+}
+
+func TestParseMetricTimerUnit(t *testing.T) {
+	defer func(s string) { *timerUnit = s }(*timerUnit)
+
+	tests := []struct {
+		unit  string
+		input string
+		want  float64
+	}{
+		{"ms", "t:1.5|ms|u:s", 1500},
+		{"s", "t:1.5|ms", 1500},
+		{"s", "t:1.5|ms|u:ms", 1.5},
+		{"s", "t:1.5|ms|u:us|@0.5", 0.0015},
+		{"ns", "t:1500000|ms", 1.5},
+
+		// Units only apply to timers
+		{"s", "g:1.5|g", 1.5},
+		{"ms", "g:1.5|g|u:s", 1.5},
+	}
+
+	for _, tt := range tests {
+		*timerUnit = tt.unit
+		m, err := parseMetric([]byte(tt.input))
+
+		if err != nil {
+			t.Errorf("parseMetric(%q) with -timer-unit %s: %s", tt.input, tt.unit, err)
+			continue
+		}
+
+		if m.Value != tt.want {
+			t.Errorf("parseMetric(%q) with -timer-unit %s: got %v, want %v",
+				tt.input, tt.unit, m.Value, tt.want)
+		}
+	}
+
+	*timerUnit = "ms"
+
+	for _, input := range []string{"t:1|ms|u:h", "t:1|ms|x:s"} {
+		if _, err := parseMetric([]byte(input)); err == nil {
+			t.Errorf("parseMetric(%q): expected error", input)
+		}
+	}
+}
+
+func TestHandleMessageNonFinite(t *testing.T) {
+	inputs := []string{"x:NaN|g", "x:Inf|g", "x:-Inf|g", "x:+Inf|ms",
+		"x:nan|d", "x:|g"}
+
+	for _, input := range inputs {
+		if _, err := parseMetric([]byte(input)); err == nil {
+			t.Errorf("parseMetric(%q): expected error", input)
+		}
+
+		before := atomic.LoadUint64(&stats.InvalidMetrics)
+		handleMessage([]byte(input), nil, "")
+
+		if got := atomic.LoadUint64(&stats.InvalidMetrics) - before; got != 1 {
+			t.Errorf("handleMessage(%q): got %d invalid, want 1", input, got)
+		}
+	}
+}
+
+func TestHandleMessageInvalidBucket(t *testing.T) {
+	before := atomic.LoadUint64(&stats.InvalidMetrics)
+	handleMessage([]byte("foo/bar:1|c"), nil, "")
+
+	if got := atomic.LoadUint64(&stats.InvalidMetrics) - before; got != 1 {
+		t.Errorf("InvalidMetrics: got %d new, want 1", got)
+	}
+}
+
+// resetMetrics clears all aggregated metrics and internal stats
+func resetMetrics() {
+	counters.Lock()
+	counters.m = make(map[string]int64)
+	counters.idle = make(map[string]int)
+	counters.rates = make(map[string]float64)
+	counters.raw = make(map[string]int64)
+	counters.window = make(map[string][]int64)
+	counters.windowPos = 0
+	counters.Unlock()
+	gauges.Lock()
+	gauges.m = make(map[string]float64)
+	gauges.min = make(map[string]float64)
+	gauges.max = make(map[string]float64)
+	gauges.sum = make(map[string]float64)
+	gauges.count = make(map[string]int64)
+	gauges.times = make(map[string]int64)
+	gauges.Unlock()
+	timers.Lock()
+	timers.m = make(map[string]Timers)
+	timers.dropped = make(map[string]int64)
+	timers.sampled = make(map[string]float64)
+	timers.digests = make(map[string]*TDigest)
+	timers.Unlock()
+	distributions.Lock()
+	distributions.m = make(map[string]Timers)
+	distributions.Unlock()
+	*stats = Stats{}
 }
 
 // TestParseMetric tests all of the parsing
@@ -42,194 +284,2629 @@ func TestParseMetric(t *testing.T) {
 				tt.input, got.Bucket, want.Bucket)
 		}
 
-		if got.Value != want.Value {
-			t.Errorf("parseMetric(%q): got: %v (%s), want %v (%s)",
-				tt.input, got.Value, reflect.TypeOf(got.Value), want.Value,
-				reflect.TypeOf(want.Value))
+		if got.Value != want.Value || got.CountValue != want.CountValue {
+			t.Errorf("parseMetric(%q): got: %v/%d, want %v/%d",
+				tt.input, got.Value, got.CountValue, want.Value, want.CountValue)
 		}
 
 		if got.Type != want.Type {
 			t.Errorf("parseMetric(%q): got: %q, want %q",
 				tt.input, got.Type, want.Type)
 		}
+
+		if got.Timestamp != want.Timestamp {
+			t.Errorf("parseMetric(%q): got timestamp %d, want %d",
+				tt.input, got.Timestamp, want.Timestamp)
+		}
 	}
 }
 
-func TestHandleMessage(t *testing.T) {
-	done := make(chan bool)
-	testTable := make(chan metricTest, len(metricTests))
+func TestParseMetricSegmentErrors(t *testing.T) {
+	for _, input := range []string{"x:1|c|c", "x:1|c|@", "x:1|@x|c", "x|y:1|c", "x:1|",
+		"x:1|g|T", "x:1|g|Tnow", "x:1|g|T-5", "x:1|g|clear",
+		"x:1|c|@150%", "x:1|c|@0", "x:1|c|@1.5", "x:1|c|@-50%", "x:1|c|@%", "x:1|c|@NaN",
+		"x:1|c|@1e", "x:1|c|@1e2", "x:1|c|@1e-400", "x:1|c|@1e-2e"} {
+		if _, err := parseMetric([]byte(input)); err == nil {
+			t.Errorf("parseMetric(%q): expected error", input)
+		}
+	}
+}
 
-	go func() {
-		for {
-			select {
-			case got := <-In:
-				tt := <-testTable
-				want := tt.expected
+func TestParseMetricNameLength(t *testing.T) {
+	defer func(n int, s string) { *maxNameLength, *longNamePolicy = n, s }(*maxNameLength, *longNamePolicy)
+	*maxNameLength = 5
 
-				if got.Bucket != want.Bucket {
-					t.Errorf("handleMessage(%q): got: %q, want %q",
-						tt.input, got.Bucket, want.Bucket)
-				}
+	tests := []struct {
+		policy string
+		input  string
+		want   string
+	}{
+		{"reject", "abcd:1|c", "abcd"},
+		{"reject", "abcde:1|c", "abcde"},
+		{"reject", "abcdef:1|c", ""},
+		{"truncate", "abcd:1|c", "abcd"},
+		{"truncate", "abcde:1|c", "abcde"},
+		{"truncate", "abcdef:1|c", "abcde"},
+	}
 
-				if got.Value != want.Value {
-					t.Errorf("handleMessage(%q): got: %v (%s), want %v (%s)",
-						tt.input, got.Value, reflect.TypeOf(got.Value), want.Value,
-						reflect.TypeOf(want.Value))
-				}
+	for _, tt := range tests {
+		*longNamePolicy = tt.policy
+		m, err := parseMetric([]byte(tt.input))
 
-				if got.Type != want.Type {
-					t.Errorf("handleMessage(%q): got: %q, want %q",
-						tt.input, got.Type, want.Type)
-				}
-			case <-done:
-				break
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseMetric(%q) with %s: expected error", tt.input, tt.policy)
 			}
+
+			continue
 		}
-	}()
 
-	for _, tt := range metricTests {
-		testTable <- tt
-		handleMessage([]byte(tt.input))
+		if err != nil {
+			t.Errorf("parseMetric(%q) with %s: %s", tt.input, tt.policy, err)
+		} else if m.Bucket != tt.want {
+			t.Errorf("parseMetric(%q) with %s: got %q, want %q",
+				tt.input, tt.policy, m.Bucket, tt.want)
+		}
 	}
 
-	done <- true
+	// Rejected names count as invalid
+	defer func(n uint64) { stats.InvalidMetrics = n }(stats.InvalidMetrics)
+	stats.InvalidMetrics = 0
+	*longNamePolicy = "reject"
+
+	if metrics := collectMetrics([]byte("abcdef:1|c\nabc:1|c"), nil); len(metrics) != 1 {
+		t.Errorf("handleMessage: got %d metrics, want 1", len(metrics))
+	}
+
+	if stats.InvalidMetrics != 1 {
+		t.Errorf("handleMessage: got %d invalid, want 1", stats.InvalidMetrics)
+	}
 }
 
-// TODO: doesn't always work...
-/*
-func TestHandleMessageMultiple(t *testing.T) {
-	//done := make(chan bool)
-	num := 0
-	input := []byte("foo:1|c\nbar:1|c\nbaz:1|c")
-	metrics := bytes.Split(input, []byte("\n"))
-	var wg sync.WaitGroup
-	wg.Add(len(metrics))
+func TestHandleMessage(t *testing.T) {
+	for _, tt := range metricTests {
+		metrics := collectMetrics([]byte(tt.input), nil)
+
+		if len(metrics) != 1 {
+			t.Errorf("handleMessage(%q): got %d metrics, want 1",
+				tt.input, len(metrics))
+			continue
+		}
 
-	go handleMessage(input)
+		got, want := metrics[0], tt.expected
 
-	go func() {
-		for got := range In {
-			fmt.Println(num)
-			fmt.Println(got)
-			num++
-			wg.Done()
+		if got.Bucket != want.Bucket {
+			t.Errorf("handleMessage(%q): got: %q, want %q",
+				tt.input, got.Bucket, want.Bucket)
 		}
-	}()
 
-	wg.Wait()
+		if got.Value != want.Value || got.CountValue != want.CountValue {
+			t.Errorf("handleMessage(%q): got: %v/%d, want %v/%d",
+				tt.input, got.Value, got.CountValue, want.Value, want.CountValue)
+		}
 
-	if num != len(metrics) {
-		t.Errorf("Error parsing multiple metrics: got %d, want %d", num,
-			len(metrics))
+		if got.Type != want.Type {
+			t.Errorf("handleMessage(%q): got: %q, want %q",
+				tt.input, got.Type, want.Type)
+		}
 	}
 }
-*/
 
-//-----------------------------------------------------------------------------
-// Benchmarks
+func TestInvalidSources(t *testing.T) {
+	defer func(n int) { *maxInvalidSources = n }(*maxInvalidSources)
+	*maxInvalidSources = 2
 
-func getBuf(size int) []byte {
-	var buf bytes.Buffer
+	invalidSources.Lock()
+	invalidSources.m = make(map[string]uint64)
+	invalidSources.Unlock()
 
-	for {
-		if buf.Len() >= size {
-			break
+	src := func(ip string) net.Addr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: 5000}
+	}
+
+	handleMessage([]byte("bad\nworse"), src("10.0.0.1"), "")
+	handleMessage([]byte("foo:x|c"), src("10.0.0.2"), "")
+	handleMessage([]byte("bad"), src("10.0.0.3"), "")
+	handleMessage([]byte("bad"), nil, "")
+
+	want := map[string]uint64{"10.0.0.1": 2, "10.0.0.2": 1, "other": 1}
+
+	invalidSources.Lock()
+	defer invalidSources.Unlock()
+
+	if !reflect.DeepEqual(invalidSources.m, want) {
+		t.Errorf("invalidSources: got %v, want %v", invalidSources.m, want)
+	}
+}
+
+func TestFlushGauges(t *testing.T) {
+	defer func(b bool) { *deleteGauges = b }(*deleteGauges)
+
+	tests := []struct {
+		delete bool
+		want   string
+	}{
+		{false, "mygauge 78 100\nmygauge 78 110\n"},
+		{true, "mygauge 78 100\n"},
+	}
+
+	for _, tt := range tests {
+		*deleteGauges = tt.delete
+		gauges.Lock()
+		gauges.m = map[string]float64{"mygauge": 78}
+		gauges.Unlock()
+
+		var buf bytes.Buffer
+		flushGauges(&buf, 100)
+		flushGauges(&buf, 110)
+
+		if got := buf.String(); got != tt.want {
+			t.Errorf("flushGauges (delete=%v): got %q, want %q",
+				tt.delete, got, tt.want)
 		}
+	}
+}
 
-		buf.Write([]byte("a:1|c\n"))
+func TestFlushGaugesZero(t *testing.T) {
+	defer func(b bool) { *deleteGauges = b }(*deleteGauges)
+	*deleteGauges = false
+
+	gauges.Lock()
+	gauges.m = make(map[string]float64)
+	gauges.Unlock()
+
+	m, err := parseMetric([]byte("zerogauge:0|g"))
+
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	return buf.Bytes()
+	gauges.Lock()
+	gauges.m[m.Bucket] = m.Value
+	gauges.Unlock()
+
+	var buf bytes.Buffer
+	flushGauges(&buf, 100)
+	flushGauges(&buf, 110)
+
+	want := "zerogauge 0 100\nzerogauge 0 110\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushGauges: got %q, want %q", got, want)
+	}
 }
 
-func benchmarkHandleMessage(size int, b *testing.B) {
-	done := make(chan bool)
-	//num := 0
+func TestProcessZeroGauge(t *testing.T) {
+	defer func(b bool) { *deleteGauges = b }(*deleteGauges)
 
-	go func() {
-		for {
-			select {
-			case <-In:
-				//num++
-			case <-done:
-				break
+	for _, del := range []bool{false, true} {
+		*deleteGauges = del
+		resetMetrics()
+
+		for _, input := range []string{"zero:0|g", "negzero:-0|g"} {
+			m, err := parseMetric([]byte(input))
+
+			if err != nil {
+				t.Fatal(err)
 			}
+
+			processMetric(m)
 		}
-	}()
 
-	buf := getBuf(size)
+		var buf bytes.Buffer
+		flushGauges(&buf, 100)
+		want := "negzero 0 100\nzero 0 100\n"
 
-	b.ResetTimer()
-	b.StartTimer()
+		if got := buf.String(); got != want {
+			t.Errorf("flushGauges (delete=%v): got %q, want %q", del, got, want)
+		}
 
-	for n := 0; n < b.N; n++ {
-		handleMessage(buf)
-	}
+		// A zero gauge persists like any other value unless -delete-gauges
+		// is set, in which case it is only emitted in the interval it was
+		// sent
+		buf.Reset()
+		flushGauges(&buf, 110)
 
-	b.StopTimer()
+		if del {
+			want = ""
+		} else {
+			want = "negzero 0 110\nzero 0 110\n"
+		}
 
-	done <- true
-	//b.Logf("Handled %d metrics", num)
+		if got := buf.String(); got != want {
+			t.Errorf("second flushGauges (delete=%v): got %q, want %q",
+				del, got, want)
+		}
+	}
 }
 
-func BenchmarkHandleMessage64(b *testing.B)   { benchmarkHandleMessage(64, b) }
-func BenchmarkHandleMessage128(b *testing.B)  { benchmarkHandleMessage(128, b) }
-func BenchmarkHandleMessage256(b *testing.B)  { benchmarkHandleMessage(256, b) }
-func BenchmarkHandleMessage512(b *testing.B)  { benchmarkHandleMessage(512, b) }
-func BenchmarkHandleMessage1024(b *testing.B) { benchmarkHandleMessage(1024, b) }
-func BenchmarkHandleMessage2048(b *testing.B) { benchmarkHandleMessage(2048, b) }
-func BenchmarkHandleMessage4096(b *testing.B) { benchmarkHandleMessage(4096, b) }
-func BenchmarkHandleMessage8192(b *testing.B) { benchmarkHandleMessage(8192, b) }
+func TestFlushGaugesMinMax(t *testing.T) {
+	defer func(b bool) { *gaugeMinMax = b }(*gaugeMinMax)
+	*gaugeMinMax = true
+	resetMetrics()
 
-// Benchmark metric parsing using different types
-func benchmarkParseMetric(s string, b *testing.B) {
-	for n := 0; n < b.N; n++ {
-		parseMetric([]byte(s))
+	for _, v := range []float64{5, 2, 8} {
+		processMetric(&Metric{Bucket: "depth", Value: v, Type: Gauge})
+	}
+
+	var buf bytes.Buffer
+	n := flushGauges(&buf, 100)
+
+	// The range resets each interval, so a gauge that isn't set again
+	// reports its last value as both the min and max
+	flushGauges(&buf, 110)
+
+	want := "depth 8 100\ndepth.min 2 100\ndepth.max 8 100\n" +
+		"depth 8 110\ndepth.min 8 110\ndepth.max 8 110\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushGauges: got %q, want %q", got, want)
+	}
+
+	if n != 3 {
+		t.Errorf("flushGauges: got n=%d, want 3", n)
 	}
 }
 
-func BenchmarkParseMetricCounter(b *testing.B) { benchmarkParseMetric("mycounter:1|c", b) }
-func BenchmarkParseMetricGauge(b *testing.B)   { benchmarkParseMetric("mygauge:78|g", b) }
-func BenchmarkParseMetricTimer(b *testing.B)   { benchmarkParseMetric("mytimer:123|ms", b) }
+func TestFlushGaugesAggregation(t *testing.T) {
+	defer func(s string) { *gaugeAggregation = s }(*gaugeAggregation)
+	defer resetMetrics()
 
-// Benchmark metric extraction using regular expressions
-var statsPattern = regexp.MustCompile(`[\w\.]+:-?\d+\|(?:c|ms|g)(?:\|\@[\d\.]+)?`)
+	for _, tt := range []struct {
+		mode string
+		want string
+	}{
+		{"last", "30"},
+		{"avg", "20"},
+		{"min", "10"},
+		{"max", "30"},
+	} {
+		*gaugeAggregation = tt.mode
+		resetMetrics()
 
-func benchmarkRegexFindAll(size int, b *testing.B) {
-	buf := getBuf(size)
+		for _, v := range []float64{10, 20, 30} {
+			processMetric(&Metric{Bucket: "temp", Value: v, Type: Gauge})
+		}
 
-	b.ResetTimer()
-	b.StartTimer()
+		var buf bytes.Buffer
+		flushGauges(&buf, 100)
 
-	for n := 0; n < b.N; n++ {
-		statsPattern.FindAll(buf, -1)
+		// An idle gauge repeats the last aggregate, and the next interval
+		// starts afresh
+		flushGauges(&buf, 110)
+		processMetric(&Metric{Bucket: "temp", Value: 40, Type: Gauge})
+		flushGauges(&buf, 120)
+
+		want := "temp " + tt.want + " 100\ntemp " + tt.want + " 110\ntemp 40 120\n"
+
+		if got := buf.String(); got != want {
+			t.Errorf("flushGauges with %s: got %q, want %q", tt.mode, got, want)
+		}
 	}
+}
 
-	b.StopTimer()
+func TestFlushGaugesBackdated(t *testing.T) {
+	resetMetrics()
+	defer resetMetrics()
+
+	for _, input := range []string{"batch.rows:40|g|T1700000000", "live:1|g"} {
+		m, err := parseMetric([]byte(input))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		processMetric(m)
+	}
+
+	var buf bytes.Buffer
+	flushGauges(&buf, 100)
+
+	// The timestamp is kept until the gauge is set again
+	flushGauges(&buf, 110)
+	processMetric(&Metric{Bucket: "batch.rows", Value: 41, Type: Gauge})
+	flushGauges(&buf, 120)
+
+	want := "batch.rows 40 1700000000\nlive 1 100\n" +
+		"batch.rows 40 1700000000\nlive 1 110\n" +
+		"batch.rows 41 120\nlive 1 120\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushGauges: got %q, want %q", got, want)
+	}
 }
 
-func BenchmarkRegexFindAll512(b *testing.B)  { benchmarkRegexFindAll(512, b) }
-func BenchmarkRegexFindAll1024(b *testing.B) { benchmarkRegexFindAll(1024, b) }
-func BenchmarkRegexFindAll2048(b *testing.B) { benchmarkRegexFindAll(2048, b) }
-func BenchmarkRegexFindAll4096(b *testing.B) { benchmarkRegexFindAll(4096, b) }
-func BenchmarkRegexFindAll8192(b *testing.B) { benchmarkRegexFindAll(8192, b) }
+func TestEmitRawCounts(t *testing.T) {
+	defer func(raw, fast bool) { *emitRawCounts, *fastCounters = raw, fast }(*emitRawCounts, *fastCounters)
+	*emitRawCounts = true
 
-// Benchmark metric extraction using bytes.Split()
-func benchmarkBytesSplit(size int, b *testing.B) {
-	buf := getBuf(size)
+	for _, fast := range []bool{false, true} {
+		*fastCounters = fast
+		resetMetrics()
+		ingest([]byte("hits:3|c\nhits:2|c|@0.5\nhits:1|c|@1\nother:1|c|@0.1"))
+		mergeCounterShards()
 
-	b.ResetTimer()
-	b.StartTimer()
+		var buf bytes.Buffer
+		n := flushCounters(&buf, 100)
 
-	for n := 0; n < b.N; n++ {
-		bytes.Split(buf, []byte("\n"))
+		want := "hits 8 100\nhits.raw 6 100\nother 10 100\nother.raw 1 100\n"
+
+		if got := buf.String(); got != want {
+			t.Errorf("flushCounters (fast-counters=%v): got %q, want %q", fast, got, want)
+		}
+
+		if n != 4 {
+			t.Errorf("flushCounters (fast-counters=%v): got n=%d, want 4", fast, n)
+		}
 	}
 
-	b.StopTimer()
+	resetMetrics()
 }
 
-func BenchmarkBytesSplit512(b *testing.B)  { benchmarkBytesSplit(512, b) }
-func BenchmarkBytesSplit1024(b *testing.B) { benchmarkBytesSplit(1024, b) }
-func BenchmarkBytesSplit2048(b *testing.B) { benchmarkBytesSplit(2048, b) }
-func BenchmarkBytesSplit4096(b *testing.B) { benchmarkBytesSplit(4096, b) }
-func BenchmarkBytesSplit8192(b *testing.B) { benchmarkBytesSplit(8192, b) }
+func TestCounterClear(t *testing.T) {
+	defer func(b bool) { *fastCounters = b }(*fastCounters)
+
+	for _, fast := range []bool{false, true} {
+		*fastCounters = fast
+		resetMetrics()
+
+		for _, input := range []string{"gorets:3|c", "gorets:4|c", "gorets:0|c|clear", "gorets:2|c"} {
+			if fast {
+				if ok, err := addFastCounter([]byte(input), ""); ok {
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					continue
+				}
+			}
+
+			m, err := parseMetric([]byte(input))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			processMetric(m)
+		}
+
+		mergeCounterShards()
+
+		var buf bytes.Buffer
+		flushCounters(&buf, 100)
+
+		if got, want := buf.String(), "gorets 2 100\n"; got != want {
+			t.Errorf("flushCounters (fast-counters=%v): got %q, want %q", fast, got, want)
+		}
+	}
+
+	resetMetrics()
+}
+
+func TestFlushCounters(t *testing.T) {
+	defer func(b bool) { *deleteCounters = b }(*deleteCounters)
+
+	tests := []struct {
+		delete bool
+		want   string
+	}{
+		{true, "mycounter 5 100\n"},
+		{false, "mycounter 5 100\nmycounter 0 110\n"},
+	}
+
+	for _, tt := range tests {
+		*deleteCounters = tt.delete
+		counters.Lock()
+		counters.m = map[string]int64{"mycounter": 5}
+		counters.Unlock()
+
+		var buf bytes.Buffer
+		flushCounters(&buf, 100)
+		flushCounters(&buf, 110)
+
+		if got := buf.String(); got != tt.want {
+			t.Errorf("flushCounters (delete=%v): got %q, want %q",
+				tt.delete, got, tt.want)
+		}
+	}
+}
+
+func TestIdleCounterFlushes(t *testing.T) {
+	defer func(b bool) { *deleteCounters = b }(*deleteCounters)
+	defer func(n int) { *idleCounterFlushes = n }(*idleCounterFlushes)
+	*deleteCounters = false
+	*idleCounterFlushes = 2
+
+	counters.Lock()
+	counters.m = map[string]int64{"idle": 5, "busy": 1}
+	counters.idle = make(map[string]int)
+	counters.Unlock()
+
+	// An idle counter sends 0 for two flushes and is then deleted. A
+	// counter updated again starts its idle count over.
+	for i, kept := range []bool{true, true, false} {
+		var buf bytes.Buffer
+		flushCounters(&buf, 100)
+		counters.m["busy"]++
+
+		if _, ok := counters.m["idle"]; ok != kept {
+			t.Errorf("flush %d: idle counter kept %v, want %v", i, ok, kept)
+		}
+
+		if _, ok := counters.m["busy"]; !ok {
+			t.Errorf("flush %d: busy counter deleted", i)
+		}
+	}
+
+	if len(counters.idle) != 0 {
+		t.Errorf("idle counts not cleared: %v", counters.idle)
+	}
+
+	counters.m = make(map[string]int64)
+}
+
+func TestCounterWindow(t *testing.T) {
+	defer func(b bool) { *deleteCounters = b }(*deleteCounters)
+	defer func(d time.Duration) { *counterWindow = d }(*counterWindow)
+	defer func(d time.Duration) { *flushInterval = d }(*flushInterval)
+	*deleteCounters = true
+	*flushInterval = 10 * time.Second
+	*counterWindow = 30 * time.Second
+	resetMetrics()
+
+	// Each flush emits the sum of the last three intervals' increments
+	tests := []struct {
+		add  int64
+		want string
+	}{
+		{5, "mycounter 5 100\n"},
+		{3, "mycounter 8 100\n"},
+		{0, "mycounter 8 100\n"},
+		{2, "mycounter 5 100\n"},
+		{0, "mycounter 2 100\n"},
+		{0, "mycounter 2 100\n"},
+		{0, "mycounter 0 100\n"},
+		{0, ""},
+	}
+
+	for i, tt := range tests {
+		if tt.add > 0 {
+			processMetric(&Metric{Bucket: "mycounter", CountValue: tt.add, Type: Counter})
+		}
+
+		var buf bytes.Buffer
+		flushCounters(&buf, 100)
+
+		if got := buf.String(); got != tt.want {
+			t.Errorf("flush %d: got %q, want %q", i+1, got, tt.want)
+		}
+	}
+
+	if len(counters.window) != 0 {
+		t.Errorf("counters.window: got %v, want empty", counters.window)
+	}
+}
+
+func TestReportSampleRate(t *testing.T) {
+	defer func(b bool) { *reportSampleRate = b }(*reportSampleRate)
+	defer func(b bool) { *deleteCounters = b }(*deleteCounters)
+	*reportSampleRate = true
+	*deleteCounters = false
+	resetMetrics()
+
+	for _, m := range collectMetrics([]byte("sampled:1|c|@0.5\nsampled:1|c|@0.25\nfull:2|c"), nil) {
+		processMetric(m)
+	}
+
+	var buf bytes.Buffer
+	flushCounters(&buf, 100)
+
+	// Only the last rate seen in the interval is reported
+	want := "full 2 100\n" +
+		"full.sample_rate 1 100\n" +
+		"sampled 6 100\n" +
+		"sampled.sample_rate 0.25 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushCounters: got %q, want %q", got, want)
+	}
+
+	// Rates are reset each interval
+	buf.Reset()
+	flushCounters(&buf, 110)
+
+	if want := "full 0 110\nsampled 0 110\n"; buf.String() != want {
+		t.Errorf("flushCounters: got %q, want %q", buf.String(), want)
+	}
+}
+
+// TestPercTinySamples checks that every percentile lands on a value for
+// samples too small to have a distinct rank for each percentile
+func TestPercTinySamples(t *testing.T) {
+	pcts := []float64{0, 1, 5, 50, 50.1, 95, 99, 99.9, 100}
+
+	for _, pct := range pcts {
+		if got := perc([]float64{7}, pct); got != 7 {
+			t.Errorf("perc([7], %v): got %v, want 7", pct, got)
+		}
+
+		want := float64(1)
+
+		if pct > 50 {
+			want = 2
+		}
+
+		if got := perc([]float64{1, 2}, pct); got != want {
+			t.Errorf("perc([1 2], %v): got %v, want %v", pct, got, want)
+		}
+	}
+}
+
+func TestParseFlushJitter(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"0":    0,
+		"2s":   2 * time.Second,
+		"20%":  2 * time.Second,
+		"100%": 10 * time.Second,
+	} {
+		got, err := parseFlushJitter(s, 10*time.Second)
+
+		if err != nil || got != want {
+			t.Errorf("parseFlushJitter(%q): got %v, %v, want %v", s, got, err, want)
+		}
+	}
+
+	for _, s := range []string{"x", "-1s", "11s", "150%", "x%"} {
+		if _, err := parseFlushJitter(s, 10*time.Second); err == nil {
+			t.Errorf("parseFlushJitter(%q): expected error", s)
+		}
+	}
+}
+
+func TestFirstFlushDelay(t *testing.T) {
+	interval, jitter := 10*time.Second, 2*time.Second
+	var min, max time.Duration
+
+	for i := 0; i < 1000; i++ {
+		d := firstFlushDelay(interval, jitter)
+
+		if d < interval || d > interval+jitter {
+			t.Fatalf("firstFlushDelay: got %v, want within [%v, %v]",
+				d, interval, interval+jitter)
+		}
+
+		if i == 0 || d < min {
+			min = d
+		}
+
+		if d > max {
+			max = d
+		}
+	}
+
+	// The offsets should be spread across the jitter, not fixed
+	if max-min < jitter/2 {
+		t.Errorf("firstFlushDelay: offsets only spread over %v", max-min)
+	}
+
+	if d := firstFlushDelay(interval, 0); d != interval {
+		t.Errorf("firstFlushDelay without jitter: got %v, want %v", d, interval)
+	}
+}
+
+func TestFlushGroups(t *testing.T) {
+	defer func(c, g, tm time.Duration) {
+		*counterFlushInterval, *gaugeFlushInterval, *timerFlushInterval = c, g, tm
+	}(*counterFlushInterval, *gaugeFlushInterval, *timerFlushInterval)
+
+	*gaugeFlushInterval = 0
+	*timerFlushInterval = *flushInterval
+	*counterFlushInterval = 0
+	want := []flushGroup{{*flushInterval, flushSections}}
+
+	if got := flushGroups(); !reflect.DeepEqual(got, want) {
+		t.Errorf("flushGroups (defaults): got %v, want %v", got, want)
+	}
+
+	*gaugeFlushInterval = 60 * time.Second
+	*timerFlushInterval = 60 * time.Second
+	want = []flushGroup{
+		{*flushInterval, []string{"counters", "distributions", "internal"}},
+		{60 * time.Second, []string{"gauges", "timers"}},
+	}
+
+	if got := flushGroups(); !reflect.DeepEqual(got, want) {
+		t.Errorf("flushGroups: got %v, want %v", got, want)
+	}
+}
+
+func TestFlushSectionsCadence(t *testing.T) {
+	defer func(c, g time.Duration) {
+		*counterFlushInterval, *gaugeFlushInterval = c, g
+	}(*counterFlushInterval, *gaugeFlushInterval)
+
+	*counterFlushInterval = 5 * time.Millisecond
+	*gaugeFlushInterval = 50 * time.Millisecond
+	due := make(chan []string)
+
+	for _, g := range flushGroups() {
+		if g.interval != *flushInterval {
+			go scheduleFlush(g, due)
+		}
+	}
+
+	// Count the counter flushes between the first two gauge flushes
+	var counterFlushes, gaugeFlushes int
+
+	for gaugeFlushes < 2 {
+		switch sections := <-due; sections[0] {
+		case "counters":
+			if gaugeFlushes == 1 {
+				counterFlushes++
+			}
+		case "gauges":
+			gaugeFlushes++
+		}
+	}
+
+	if counterFlushes < 5 {
+		t.Errorf("scheduleFlush: got %d counter flushes per gauge flush, want about 10",
+			counterFlushes)
+	}
+
+	// A flush of one section leaves the others to their own schedule
+	resetMetrics()
+	defer resetMetrics()
+	processMetric(&Metric{Bucket: "hits", CountValue: 2, Type: Counter})
+	processMetric(&Metric{Bucket: "depth", Value: 3, Type: Gauge})
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, 100, []string{"counters"})
+	writeMetrics(&buf, 110, []string{"gauges"})
+
+	if got, want := buf.String(), "hits 2 100\ndepth 3 110\n"; got != want {
+		t.Errorf("writeMetrics: got %q, want %q", got, want)
+	}
+}
+
+func TestParsePercentiles(t *testing.T) {
+	got, err := parsePercentiles("5, 95,99.9")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []float64{5, 95, 99.9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePercentiles: got %v, want %v", got, want)
+	}
+
+	if _, err := parsePercentiles("101"); err == nil {
+		t.Error("parsePercentiles(\"101\"): expected error")
+	}
+
+	if got := percName(99.9); got != "99_9" {
+		t.Errorf("percName(99.9): got %q, want %q", got, "99_9")
+	}
+}
+
+func TestFlushCRLF(t *testing.T) {
+	defer func(s string) { eol = s }(eol)
+	eol = "\r\n"
+
+	counters.Lock()
+	counters.m = map[string]int64{"mycounter": 5}
+	counters.Unlock()
+	timers.Lock()
+	timers.m = map[string]Timers{"mytimer": {1}}
+	timers.Unlock()
+
+	var buf bytes.Buffer
+	flushCounters(&buf, 100)
+	flushTimers(&buf, 100)
+
+	want := "mycounter 5 100\r\n" +
+		"mytimer.count 1 100\r\n" +
+		"mytimer.count_ps 0.1 100\r\n" +
+		"mytimer.mean 1.000000 100\r\n" +
+		"mytimer.lower 1.000000 100\r\n" +
+		"mytimer.upper 1.000000 100\r\n" +
+		"mytimer.perc5 1.000000 100\r\n" +
+		"mytimer.mean_5 1.000000 100\r\n" +
+		"mytimer.upper_5 1.000000 100\r\n" +
+		"mytimer.perc95 1.000000 100\r\n" +
+		"mytimer.mean_95 1.000000 100\r\n" +
+		"mytimer.upper_95 1.000000 100\r\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flush with CRLF: got %q, want %q", got, want)
+	}
+}
+
+func TestUptime(t *testing.T) {
+	defer func(t time.Time) { startTime = t }(startTime)
+	startTime = time.Unix(1000, 0)
+
+	for _, now := range []int64{1010, 1020} {
+		var buf bytes.Buffer
+		flushInternalStats(&buf, now)
+		want := fmt.Sprintf("statsd.uptime_seconds %d %d\n", now-1000, now)
+
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("flushInternalStats(%d): %q not found in %q",
+				now, want, buf.String())
+		}
+	}
+}
+
+func TestQueueDropped(t *testing.T) {
+	defer func(c chan *Metric) { In = c }(In)
+	In = make(chan *Metric, 2)
+	resetMetrics()
+
+	handleMessage([]byte("a:1|c\nb:1|c\nc:1|c\nd:1|c\ne:1|c"), nil, "")
+
+	if got := atomic.LoadUint64(&stats.QueueDropped); got != 3 {
+		t.Errorf("QueueDropped: got %d, want 3", got)
+	}
+
+	var buf bytes.Buffer
+	flushInternalStats(&buf, 100)
+
+	for _, want := range []string{"statsd.queue.depth 2 100\n", "statsd.queue.dropped 3 100\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("flushInternalStats: %q not found in %q", want, buf.String())
+		}
+	}
+
+	if got := atomic.LoadUint64(&stats.QueueDropped); got != 0 {
+		t.Errorf("QueueDropped: got %d after flush, want 0", got)
+	}
+}
+
+// TestInternalStatsConcurrentFlush checks that metrics received while
+// internal stats are flushed are counted in exactly one interval
+func TestInternalStatsConcurrentFlush(t *testing.T) {
+	defer func(m map[string]bool) { internalStats = m }(internalStats)
+	internalStats = map[string]bool{"metrics.recv": true}
+	atomic.StoreUint64(&stats.RecvMetrics, 0)
+
+	const workers, increments = 4, 10000
+	done := make(chan bool)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := 0; j < increments; j++ {
+				atomic.AddUint64(&stats.RecvMetrics, 1)
+			}
+
+			done <- true
+		}()
+	}
+
+	var total uint64
+
+	flush := func() {
+		var buf bytes.Buffer
+		flushInternalStats(&buf, 100)
+
+		var n uint64
+		fmt.Sscanf(buf.String(), "statsd.metrics.recv %d 100", &n)
+		total += n
+	}
+
+	for finished := 0; finished < workers; {
+		select {
+		case <-done:
+			finished++
+		default:
+			flush()
+		}
+	}
+
+	flush()
+
+	if total != workers*increments {
+		t.Errorf("flushInternalStats: counted %d metrics, want %d",
+			total, workers*increments)
+	}
+}
+
+func TestActiveBuckets(t *testing.T) {
+	defer func(m map[string]bool) { internalStats = m }(internalStats)
+	internalStats = map[string]bool{
+		"counters.active": true, "gauges.active": true,
+		"timers.active": true, "distributions.active": true,
+	}
+	resetMetrics()
+
+	for _, m := range collectMetrics([]byte("a:1|c\nb:1|c\na:2|c\nc:1|c\n"+
+		"g:1|g\ng:2|g\nt:1|ms\nu:1|ms\nd:1|d"), nil) {
+		processMetric(m)
+	}
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, 100, flushSections)
+
+	for _, want := range []string{
+		"statsd.counters.active 3 100\n",
+		"statsd.gauges.active 1 100\n",
+		"statsd.timers.active 2 100\n",
+		"statsd.distributions.active 1 100\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("writeMetrics: %q not found in %q", want, buf.String())
+		}
+	}
+}
+
+func TestCanary(t *testing.T) {
+	defer func(b bool) { *canary = b }(*canary)
+
+	for _, enabled := range []bool{false, true} {
+		*canary = enabled
+		var buf bytes.Buffer
+		flushInternalStats(&buf, 1234)
+
+		found := strings.Contains(buf.String(), "statsd.canary 1234 1234\n")
+
+		if found != enabled {
+			t.Errorf("flushInternalStats (canary=%v): canary found=%v in %q",
+				enabled, found, buf.String())
+		}
+	}
+}
+
+func TestInternalStatsFilter(t *testing.T) {
+	defer func(m map[string]bool) { internalStats = m }(internalStats)
+	internalStats = map[string]bool{"metrics.recv": true, "timers.sent": true}
+
+	atomic.StoreUint64(&stats.RecvMetrics, 3)
+	atomic.StoreUint64(&stats.SentTimers, 2)
+
+	var buf bytes.Buffer
+	flushInternalStats(&buf, 100)
+
+	want := "statsd.timers.sent 2 100\nstatsd.metrics.recv 3 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushInternalStats: got %q, want %q", got, want)
+	}
+}
+
+func TestInternalPrefix(t *testing.T) {
+	defer func(s string) { *internalPrefix = s }(*internalPrefix)
+	defer func(b bool) { *noInternalStats = b }(*noInternalStats)
+	defer func(m map[string]bool) { internalStats = m }(internalStats)
+	internalStats = map[string]bool{"metrics.recv": true, "metrics.per_second": true}
+	*internalPrefix = "statsd.host1"
+
+	atomic.StoreUint64(&stats.RecvMetrics, 25)
+
+	var buf bytes.Buffer
+	flushInternalStats(&buf, 100)
+
+	want := "statsd.host1.metrics.per_second 2.5 100\n" +
+		"statsd.host1.metrics.recv 25 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushInternalStats: got %q, want %q", got, want)
+	}
+
+	*noInternalStats = true
+	buf.Reset()
+	flushInternalStats(&buf, 110)
+
+	if buf.Len() != 0 {
+		t.Errorf("flushInternalStats (no-internal-stats): got %q", buf.String())
+	}
+}
+
+func TestNoInternalStatsFlush(t *testing.T) {
+	defer func(b bool) { *noInternalStats = b }(*noInternalStats)
+	*noInternalStats = true
+	resetMetrics()
+	defer resetMetrics()
+
+	processMetric(&Metric{Bucket: "hits", CountValue: 3, Type: Counter})
+	processMetric(&Metric{Bucket: "depth", Value: 4, Type: Gauge})
+	atomic.StoreUint64(&stats.RecvMetrics, 2)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, 100, flushSections)
+
+	want := "hits 3 100\ndepth 4 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("writeMetrics (no-internal-stats): got %q, want %q", got, want)
+	}
+
+	// The stats are still reset so they don't carry over or overflow
+	if n := atomic.LoadUint64(&stats.RecvMetrics); n != 0 {
+		t.Errorf("RecvMetrics: got %d after flush, want 0", n)
+	}
+}
+
+func TestInternalHostname(t *testing.T) {
+	defer func(h string, b bool) { *hostname, *internalHostname = h, b }(*hostname, *internalHostname)
+	defer func(m map[string]bool) { internalStats = m }(internalStats)
+	internalStats = map[string]bool{"metrics.sent": true, "uptime_seconds": true}
+	*hostname = "web-01.dc1.example.com"
+	*internalHostname = true
+	atomic.StoreUint64(&stats.SentMetrics, 7)
+
+	var buf bytes.Buffer
+	flushInternalStats(&buf, startTime.Unix()+5)
+
+	want := fmt.Sprintf("statsd.web-01_dc1_example_com.metrics.sent 7 %d\n"+
+		"statsd.web-01_dc1_example_com.uptime_seconds 5 %d\n",
+		startTime.Unix()+5, startTime.Unix()+5)
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushInternalStats: got %q, want %q", got, want)
+	}
+}
+
+func TestInternalStatsPerSecond(t *testing.T) {
+	defer func(d time.Duration) { *flushInterval = d }(*flushInterval)
+	defer func(m map[string]bool) { internalStats = m }(internalStats)
+	*flushInterval = 20 * time.Second
+	internalStats = map[string]bool{
+		"metrics.per_second":  true,
+		"counters.per_second": true,
+		"timers.per_second":   true,
+	}
+
+	resetMetrics()
+	atomic.StoreUint64(&stats.RecvMetrics, 200)
+	atomic.StoreUint64(&stats.RecvCounters, 150)
+	atomic.StoreUint64(&stats.RecvTimers, 50)
+
+	var buf bytes.Buffer
+	flushInternalStats(&buf, 100)
+
+	want := "statsd.metrics.per_second 10 100\n" +
+		"statsd.counters.per_second 7.5 100\n" +
+		"statsd.timers.per_second 2.5 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushInternalStats: got %q, want %q", got, want)
+	}
+}
+
+func TestMaxBuckets(t *testing.T) {
+	defer func(n int) { *maxBuckets = n }(*maxBuckets)
+	*maxBuckets = 3
+	resetMetrics()
+
+	for i := 0; i <= *maxBuckets; i++ {
+		processMetric(&Metric{Bucket: fmt.Sprintf("c%d", i), CountValue: 1, Type: Counter})
+		processMetric(&Metric{Bucket: fmt.Sprintf("t%d", i), Value: 1, Type: Timer})
+	}
+
+	// Existing buckets keep updating
+	processMetric(&Metric{Bucket: "c0", CountValue: 1, Type: Counter})
+
+	if want := map[string]int64{"c0": 2, "c1": 1, "c2": 1}; !reflect.DeepEqual(counters.m, want) {
+		t.Errorf("counters: got %v, want %v", counters.m, want)
+	}
+
+	if len(timers.m) != 3 {
+		t.Errorf("timers: got %d buckets, want 3", len(timers.m))
+	}
+
+	if got := atomic.LoadUint64(&stats.CardinalityDropped); got != 2 {
+		t.Errorf("CardinalityDropped: got %d, want 2", got)
+	}
+}
+
+func TestFlushTimersPercentileMeans(t *testing.T) {
+	defer setPercentiles(Percentiles())
+	setPercentiles([]float64{50, 90})
+
+	timers.Lock()
+	timers.m = map[string]Timers{"mytimer": {10, 9, 8, 7, 6, 5, 4, 3, 2, 1}}
+	timers.Unlock()
+
+	var buf bytes.Buffer
+	n := flushTimers(&buf, 100)
+
+	want := "mytimer.count 10 100\n" +
+		"mytimer.count_ps 1 100\n" +
+		"mytimer.mean 5.500000 100\n" +
+		"mytimer.lower 1.000000 100\n" +
+		"mytimer.upper 10.000000 100\n" +
+		"mytimer.perc50 5.000000 100\n" +
+		"mytimer.mean_50 3.000000 100\n" +
+		"mytimer.upper_50 5.000000 100\n" +
+		"mytimer.perc90 9.000000 100\n" +
+		"mytimer.mean_90 5.000000 100\n" +
+		"mytimer.upper_90 9.000000 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushTimers: got %q, want %q", got, want)
+	}
+
+	if n != 11 {
+		t.Errorf("flushTimers: got n=%d, want 11", n)
+	}
+}
+
+func TestCompactFloats(t *testing.T) {
+	defer func(b bool) { *compactFloats = b }(*compactFloats)
+	defer setPercentiles(Percentiles())
+	setPercentiles([]float64{50})
+
+	tests := []struct {
+		compact bool
+		want    string
+	}{
+		{false, "t.mean 12.250000 100\nt.lower 12.000000 100\nt.upper 12.500000 100\n" +
+			"d.distribution.avg 3.000000 100\n"},
+		{true, "t.mean 12.25 100\nt.lower 12 100\nt.upper 12.5 100\n" +
+			"d.distribution.avg 3 100\n"},
+	}
+
+	for _, tt := range tests {
+		*compactFloats = tt.compact
+		resetMetrics()
+		processMetric(&Metric{Bucket: "t", Value: 12, Type: Timer})
+		processMetric(&Metric{Bucket: "t", Value: 12.5, Type: Timer})
+		processMetric(&Metric{Bucket: "d", Value: 3, Type: Distribution})
+
+		var buf bytes.Buffer
+		flushTimers(&buf, 100)
+		flushDistributions(&buf, 100)
+
+		var got string
+
+		for _, line := range strings.SplitAfter(buf.String(), "\n") {
+			for _, name := range []string{"t.mean ", "t.lower ", "t.upper ", "d.distribution.avg "} {
+				if strings.HasPrefix(line, name) {
+					got += line
+				}
+			}
+		}
+
+		if got != tt.want {
+			t.Errorf("compact-floats=%v: got %q, want %q", tt.compact, got, tt.want)
+		}
+	}
+
+	resetMetrics()
+}
+
+func TestFlushTimersKeepIdle(t *testing.T) {
+	defer func(b bool) { *deleteTimers = b }(*deleteTimers)
+	*deleteTimers = false
+	resetMetrics()
+	defer resetMetrics()
+
+	processMetric(&Metric{Bucket: "db.query", Value: 10, Type: Timer})
+	processMetric(&Metric{Bucket: "db.query", Value: 20, Type: Timer})
+
+	var buf bytes.Buffer
+	flushTimers(&buf, 100)
+
+	if !strings.Contains(buf.String(), "db.query.count 2 100\n") {
+		t.Errorf("flushTimers: first flush missing count in %q", buf.String())
+	}
+
+	// The bucket is kept and reports a zero count without values
+	buf.Reset()
+	n := flushTimers(&buf, 110)
+
+	if got, want := buf.String(), "db.query.count 0 110\ndb.query.count_ps 0 110\n"; got != want {
+		t.Errorf("flushTimers: idle flush got %q, want %q", got, want)
+	}
+
+	if n != 2 {
+		t.Errorf("flushTimers: idle flush got n=%d, want 2", n)
+	}
+
+	// New values are flushed in full again
+	processMetric(&Metric{Bucket: "db.query", Value: 30, Type: Timer})
+	buf.Reset()
+	flushTimers(&buf, 120)
+
+	for _, want := range []string{"db.query.count 1 120\n", "db.query.upper 30.000000 120\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("flushTimers: %q not found in %q", want, buf.String())
+		}
+	}
+}
+
+func TestFlushTimersEmptyBucket(t *testing.T) {
+	resetMetrics()
+	defer resetMetrics()
+
+	// Empty buckets sort either side of one with values, which must still
+	// be flushed
+	timers.m["a.empty"] = Timers{}
+	timers.m["b.timer"] = Timers{5}
+	timers.m["c.dropped"] = nil
+	timers.dropped["c.dropped"] = 3
+
+	var buf bytes.Buffer
+	n := flushTimers(&buf, 100)
+
+	if !strings.Contains(buf.String(), "b.timer.count 1 100\n") {
+		t.Errorf("flushTimers: b.timer not flushed in %q", buf.String())
+	}
+
+	if strings.Contains(buf.String(), "a.empty") || strings.Contains(buf.String(), "c.dropped") {
+		t.Errorf("flushTimers: empty buckets flushed in %q", buf.String())
+	}
+
+	if want := 5 + 3*uint64(len(Percentiles())); n != want {
+		t.Errorf("flushTimers: got n=%d, want %d", n, want)
+	}
+
+	if len(timers.m) != 0 || len(timers.dropped) != 0 {
+		t.Errorf("flushTimers: buckets left after flush: %v %v", timers.m, timers.dropped)
+	}
+}
+
+func TestFlushTimersCountPerSecond(t *testing.T) {
+	resetMetrics()
+
+	for i := 0; i < 50; i++ {
+		processMetric(&Metric{Bucket: "mytimer", Value: float64(i), Type: Timer,
+			SampleRate: 1})
+	}
+
+	var buf bytes.Buffer
+	flushTimers(&buf, 100)
+
+	// 50 observations over the 10s flush interval
+	if want := "mytimer.count_ps 5 100\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("flushTimers: %q not found in %q", want, buf.String())
+	}
+}
+
+func TestFlushTimersMultiplier(t *testing.T) {
+	defer setPercentiles(Percentiles())
+	defer func(m float64) { *timerMultiplier = m }(*timerMultiplier)
+	setPercentiles([]float64{50})
+	*timerMultiplier = 0.001
+
+	timers.Lock()
+	timers.m = map[string]Timers{"mytimer": {1500, 500, 1000}}
+	timers.Unlock()
+
+	var buf bytes.Buffer
+	flushTimers(&buf, 100)
+
+	// The count is not scaled
+	want := "mytimer.count 3 100\n" +
+		"mytimer.count_ps 0.3 100\n" +
+		"mytimer.mean 1.000000 100\n" +
+		"mytimer.lower 0.500000 100\n" +
+		"mytimer.upper 1.500000 100\n" +
+		"mytimer.perc50 1.000000 100\n" +
+		"mytimer.mean_50 0.750000 100\n" +
+		"mytimer.upper_50 1.000000 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushTimers: got %q, want %q", got, want)
+	}
+}
+
+func TestFlushTimersNaming(t *testing.T) {
+	defer setPercentiles(Percentiles())
+	defer func(s string) { *percentileSuffix = s }(*percentileSuffix)
+	defer func(n int) { *valuePrecision = n }(*valuePrecision)
+	setPercentiles([]float64{95})
+	*percentileSuffix = "p"
+	*valuePrecision = 2
+
+	timers.Lock()
+	timers.m = map[string]Timers{"mytimer": {12.345, 1}}
+	timers.Unlock()
+
+	var buf bytes.Buffer
+	flushTimers(&buf, 100)
+
+	want := "mytimer.count 2 100\n" +
+		"mytimer.count_ps 0.2 100\n" +
+		"mytimer.mean 6.67 100\n" +
+		"mytimer.lower 1.00 100\n" +
+		"mytimer.upper 12.35 100\n" +
+		"mytimer.p95 12.35 100\n" +
+		"mytimer.mean_95 6.67 100\n" +
+		"mytimer.upper_95 12.35 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushTimers: got %q, want %q", got, want)
+	}
+}
+
+func TestHistogramAlias(t *testing.T) {
+	resetMetrics()
+
+	for _, input := range []string{"latency:10|h", "latency:20|ms", "latency:30|h|@0.5"} {
+		m, err := parseMetric([]byte(input))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Type != Timer {
+			t.Errorf("parseMetric(%q): got type %q, want %q", input, m.Type, Timer)
+		}
+
+		processMetric(m)
+	}
+
+	var buf bytes.Buffer
+	flushTimers(&buf, 100)
+
+	for _, want := range []string{"latency.count 4 100\n", "latency.mean 20.000000 100\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("flushTimers: %q not found in %q", want, buf.String())
+		}
+	}
+}
+
+func TestParseTypeAliases(t *testing.T) {
+	got, err := parseTypeAliases("h=ms, hist=d,cnt=c")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"h": Timer, "hist": Distribution, "cnt": Counter}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTypeAliases: got %v, want %v", got, want)
+	}
+
+	for _, s := range []string{"h", "=ms", "h=", "h=x"} {
+		if _, err := parseTypeAliases(s); err == nil {
+			t.Errorf("parseTypeAliases(%q): expected error", s)
+		}
+	}
+
+	defer func(m map[string]string) { typeAliases = m }(typeAliases)
+	typeAliases = got
+
+	if m, err := parseMetric([]byte("hits:2|cnt")); err != nil || m.Type != Counter {
+		t.Errorf("parseMetric(hits:2|cnt): got %+v, %v", m, err)
+	}
+}
+
+func TestTimerSampleRate(t *testing.T) {
+	resetMetrics()
+
+	m, err := parseMetric([]byte("x:100|ms|@0.1"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Value != 100 || m.SampleRate != 0.1 {
+		t.Errorf("parseMetric: got %+v, want value 100 at rate 0.1", m)
+	}
+
+	processMetric(m)
+	processMetric(&Metric{Bucket: "x", Value: 200, Type: Timer, SampleRate: 1})
+
+	var buf bytes.Buffer
+	flushTimers(&buf, 100)
+
+	// The sampled value counts as 10 observations but the aggregates only
+	// use the values received
+	for _, want := range []string{"x.count 11 100\n", "x.mean 150.000000 100\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("flushTimers: %q not found in %q", want, buf.String())
+		}
+	}
+
+	// Gauges ignore the sample rate
+	m, err = parseMetric([]byte("g:5|g|@0.1"))
+
+	if err != nil || m.Value != 5 {
+		t.Errorf("parseMetric(g:5|g|@0.1): got %+v, %v", m, err)
+	}
+}
+
+func TestTimerReservoir(t *testing.T) {
+	defer func(n int) { *timerReservoirSize = n }(*timerReservoirSize)
+	*timerReservoirSize = 100
+	resetMetrics()
+
+	for i := 0; i < 10000; i++ {
+		processMetric(&Metric{Bucket: "mytimer", Value: float64(i), Type: Timer})
+	}
+
+	samples := timers.m["mytimer"]
+
+	if len(samples) != 100 {
+		t.Fatalf("reservoir: got %d samples, want 100", len(samples))
+	}
+
+	// The sample of 0..9999 should be spread across the whole range
+	var sum float64
+
+	for _, v := range samples {
+		sum += v
+	}
+
+	if mean := sum / 100; mean < 3500 || mean > 6500 {
+		t.Errorf("reservoir: sample mean %f is not near 5000", mean)
+	}
+
+	var buf bytes.Buffer
+	flushTimers(&buf, 100)
+
+	if want := "mytimer.count 10000 100\n"; !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("flushTimers: got %q, want prefix %q", buf.String(), want)
+	}
+
+	if len(timers.dropped) != 0 {
+		t.Errorf("flushTimers: dropped counts not cleared: %v", timers.dropped)
+	}
+}
+
+func TestFlushDistributions(t *testing.T) {
+	distributions.Lock()
+	distributions.m = map[string]Timers{"mydist": {4, 1, 3, 2}}
+	distributions.Unlock()
+
+	var buf bytes.Buffer
+	n := flushDistributions(&buf, 100)
+
+	want := "mydist.distribution.count 4 100\n" +
+		"mydist.distribution.avg 2.500000 100\n" +
+		"mydist.distribution.perc5 1.000000 100\n" +
+		"mydist.distribution.perc95 4.000000 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushDistributions: got %q, want %q", got, want)
+	}
+
+	if n != 4 {
+		t.Errorf("flushDistributions: got n=%d, want 4", n)
+	}
+
+	if len(distributions.m) != 0 {
+		t.Errorf("flushDistributions: %d buckets left after flush",
+			len(distributions.m))
+	}
+}
+
+func TestFlushOrder(t *testing.T) {
+	defer func(o []string) { FlushOrder = o }(FlushOrder)
+	defer func(m map[string]bool) { internalStats = m }(internalStats)
+	internalStats = map[string]bool{"uptime_seconds": true}
+
+	order, err := parseFlushOrder("internal, timers")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"internal", "timers", "counters", "gauges", "distributions"}
+
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("parseFlushOrder: got %v, want %v", order, want)
+	}
+
+	FlushOrder = order
+
+	counters.Lock()
+	counters.m = map[string]int64{"mycounter": 1}
+	counters.Unlock()
+	gauges.Lock()
+	gauges.m = map[string]float64{"mygauge": 2}
+	gauges.Unlock()
+	timers.Lock()
+	timers.m = map[string]Timers{"mytimer": {3}}
+	timers.Unlock()
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, 100, flushSections)
+
+	var got []string
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		prefix := strings.SplitN(line, ".", 2)[0]
+		prefix = strings.Fields(prefix)[0]
+
+		if len(got) == 0 || got[len(got)-1] != prefix {
+			got = append(got, prefix)
+		}
+	}
+
+	if want := []string{"statsd", "mytimer", "mycounter", "mygauge"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("writeMetrics: got section order %v, want %v", got, want)
+	}
+
+	for _, input := range []string{"counters,bogus", "gauges,gauges"} {
+		if _, err := parseFlushOrder(input); err == nil {
+			t.Errorf("parseFlushOrder(%q): expected error", input)
+		}
+	}
+}
+
+// collectMetrics calls handleMessage and returns the metrics it queued
+func collectMetrics(buf []byte, src net.Addr) []*Metric {
+	var got []*Metric
+	handleMessage(buf, src, "")
+
+	for {
+		select {
+		case m := <-In:
+			got = append(got, m)
+		default:
+			return got
+		}
+	}
+}
+
+func TestHandleMessageMultiple(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"foo:1|c\nbar:2|g\nbaz:3|ms", []string{"foo", "bar", "baz"}},
+		{"foo:1|c\nbar:2|g\nbaz:3|ms\n", []string{"foo", "bar", "baz"}},
+		{"host app: foo:1|c\nhost app: bar:2|g", []string{"foo", "bar"}},
+	}
+
+	for _, tt := range tests {
+		got := collectMetrics([]byte(tt.input), nil)
+
+		if len(got) != len(tt.want) {
+			t.Errorf("handleMessage(%q): got %d metrics, want %d",
+				tt.input, len(got), len(tt.want))
+			continue
+		}
+
+		for i, m := range got {
+			if m.Bucket != tt.want[i] {
+				t.Errorf("handleMessage(%q): metric %d: got %q, want %q",
+					tt.input, i, m.Bucket, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestHandleMessageEmptyLines(t *testing.T) {
+	before := atomic.LoadUint64(&stats.InvalidMetrics)
+	got := collectMetrics([]byte("foo:1|c\n\nbar:2|c\n \n"), nil)
+
+	if len(got) != 2 {
+		t.Errorf("handleMessage: got %d metrics, want 2", len(got))
+	}
+
+	if n := atomic.LoadUint64(&stats.InvalidMetrics) - before; n != 0 {
+		t.Errorf("handleMessage: got %d invalid metrics, want 0", n)
+	}
+}
+
+// errListener is a net.Listener whose Accept always fails
+type errListener struct {
+	net.Listener
+	accepts int32
+	closed  int32
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func (l *errListener) Accept() (net.Conn, error) {
+	atomic.AddInt32(&l.accepts, 1)
+
+	if atomic.LoadInt32(&l.closed) == 1 {
+		return nil, net.ErrClosed
+	}
+
+	return nil, tempError{}
+}
+
+func TestServeTCPAcceptBackoff(t *testing.T) {
+	l := &errListener{}
+	done := make(chan error)
+	before := atomic.LoadUint64(&stats.ListenerErrors)
+
+	go func() {
+		done <- serveTCP(l, "", nil)
+	}()
+
+	// Backoff of 5, 10, 20, 40, 80ms allows only a handful of attempts
+	time.Sleep(100 * time.Millisecond)
+	n := atomic.LoadInt32(&l.accepts)
+
+	if n > 6 {
+		t.Errorf("serveTCP: %d accept attempts in 100ms, expected backoff", n)
+	}
+
+	if got := atomic.LoadUint64(&stats.ListenerErrors) - before; got < 1 || got > uint64(n) {
+		t.Errorf("ListenerErrors: got %d new for %d failed accepts", got, n)
+	}
+
+	// Closing the listener stops the accept loop without counting an error
+	atomic.StoreInt32(&l.closed, 1)
+	time.Sleep(100 * time.Millisecond)
+	errs := atomic.LoadUint64(&stats.ListenerErrors)
+
+	select {
+	case err := <-done:
+		if err != net.ErrClosed {
+			t.Errorf("serveTCP: got %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("serveTCP: did not return after listener was closed")
+	}
+
+	if got := atomic.LoadUint64(&stats.ListenerErrors); got != errs {
+		t.Errorf("ListenerErrors: closing the listener counted %d errors", got-errs)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	slots := make(chan struct{}, 2)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- serveTCP(l, "", slots)
+	}()
+
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	before := atomic.LoadUint64(&stats.ConnectionsRejected)
+
+	// Fill the slots, making sure each connection is being handled
+	var open []net.Conn
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+		open = append(open, conn)
+		conn.Write([]byte("conn:1|c\n"))
+
+		select {
+		case <-In:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d: timed out waiting for metric", i)
+		}
+	}
+
+	// Connections over the limit are closed straight away
+	conn, err := net.Dial("tcp", l.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection over the limit: got %v, want EOF", err)
+	}
+
+	conn.Close()
+
+	if got := atomic.LoadUint64(&stats.ConnectionsRejected) - before; got != 1 {
+		t.Errorf("ConnectionsRejected: got %d new, want 1", got)
+	}
+
+	// Closing a connection frees its slot
+	open[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(slots) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("slot not released after the connection closed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeUDPClosed(t *testing.T) {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- serveUDP(sock, "")
+	}()
+
+	sock.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("serveUDP: got %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("serveUDP: did not return after the socket was closed")
+	}
+}
+
+//-----------------------------------------------------------------------------
+// Benchmarks
+
+func getBuf(size int) []byte {
+	var buf bytes.Buffer
+
+	for {
+		if buf.Len() >= size {
+			break
+		}
+
+		buf.Write([]byte("a:1|c\n"))
+	}
+
+	return buf.Bytes()
+}
+
+func benchmarkHandleMessage(size int, b *testing.B) {
+	done := make(chan bool)
+	//num := 0
+
+	go func() {
+		for {
+			select {
+			case <-In:
+				//num++
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	buf := getBuf(size)
+
+	b.ResetTimer()
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		handleMessage(buf, nil, "")
+	}
+
+	b.StopTimer()
+
+	done <- true
+	//b.Logf("Handled %d metrics", num)
+}
+
+// Benchmark counter aggregation with and without -fast-counters
+func benchmarkCounters(fast bool, b *testing.B) {
+	defer func(f bool) { *fastCounters = f }(*fastCounters)
+	*fastCounters = fast
+	resetMetrics()
+	done := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case m := <-In:
+				processMetric(m)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	buf := getBuf(1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		handleMessage(buf, nil, "")
+	}
+
+	b.StopTimer()
+	done <- true
+}
+
+func BenchmarkHandleMessageCounters(b *testing.B)     { benchmarkCounters(false, b) }
+func BenchmarkHandleMessageFastCounters(b *testing.B) { benchmarkCounters(true, b) }
+
+func BenchmarkHandleMessage64(b *testing.B)   { benchmarkHandleMessage(64, b) }
+func BenchmarkHandleMessage128(b *testing.B)  { benchmarkHandleMessage(128, b) }
+func BenchmarkHandleMessage256(b *testing.B)  { benchmarkHandleMessage(256, b) }
+func BenchmarkHandleMessage512(b *testing.B)  { benchmarkHandleMessage(512, b) }
+func BenchmarkHandleMessage1024(b *testing.B) { benchmarkHandleMessage(1024, b) }
+func BenchmarkHandleMessage2048(b *testing.B) { benchmarkHandleMessage(2048, b) }
+func BenchmarkHandleMessage4096(b *testing.B) { benchmarkHandleMessage(4096, b) }
+func BenchmarkHandleMessage8192(b *testing.B) { benchmarkHandleMessage(8192, b) }
+
+// Benchmark metric parsing using different types
+func benchmarkParseMetric(s string, b *testing.B) {
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		parseMetric([]byte(s))
+	}
+}
+
+func BenchmarkParseMetricCounter(b *testing.B) { benchmarkParseMetric("mycounter:1|c", b) }
+func BenchmarkParseMetricGauge(b *testing.B)   { benchmarkParseMetric("mygauge:78|g", b) }
+func BenchmarkParseMetricTimer(b *testing.B)   { benchmarkParseMetric("mytimer:123|ms", b) }
+
+// Benchmark metric extraction using regular expressions
+var statsPattern = regexp.MustCompile(`[\w\.]+:-?\d+\|(?:c|ms|g)(?:\|\@[\d\.]+)?`)
+
+func benchmarkRegexFindAll(size int, b *testing.B) {
+	buf := getBuf(size)
+
+	b.ResetTimer()
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		statsPattern.FindAll(buf, -1)
+	}
+
+	b.StopTimer()
+}
+
+func BenchmarkRegexFindAll512(b *testing.B)  { benchmarkRegexFindAll(512, b) }
+func BenchmarkRegexFindAll1024(b *testing.B) { benchmarkRegexFindAll(1024, b) }
+func BenchmarkRegexFindAll2048(b *testing.B) { benchmarkRegexFindAll(2048, b) }
+func BenchmarkRegexFindAll4096(b *testing.B) { benchmarkRegexFindAll(4096, b) }
+func BenchmarkRegexFindAll8192(b *testing.B) { benchmarkRegexFindAll(8192, b) }
+
+// Benchmark metric extraction using bytes.Split()
+func benchmarkBytesSplit(size int, b *testing.B) {
+	buf := getBuf(size)
+
+	b.ResetTimer()
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		bytes.Split(buf, []byte("\n"))
+	}
+
+	b.StopTimer()
+}
+
+func BenchmarkBytesSplit512(b *testing.B)  { benchmarkBytesSplit(512, b) }
+func BenchmarkBytesSplit1024(b *testing.B) { benchmarkBytesSplit(1024, b) }
+func BenchmarkBytesSplit2048(b *testing.B) { benchmarkBytesSplit(2048, b) }
+func BenchmarkBytesSplit4096(b *testing.B) { benchmarkBytesSplit(4096, b) }
+func BenchmarkBytesSplit8192(b *testing.B) { benchmarkBytesSplit(8192, b) }
+
+func TestParseListeners(t *testing.T) {
+	got, err := parseListeners("internal=:8126, external=[::1]:8127")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []NamedListener{
+		{Name: "internal", Addr: ":8126"},
+		{Name: "external", Addr: "[::1]:8127"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseListeners: got %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{"internal", "=:8126", "internal=", "bad/name=:8126"} {
+		if _, err := parseListeners(s); err == nil {
+			t.Errorf("parseListeners(%q): expected error", s)
+		}
+	}
+}
+
+// startTCP serves a listener in the background. The returned func closes it
+// and waits for serveTCP and its connections to finish.
+func startTCP(l net.Listener, prefix string) func() {
+	done := make(chan error)
+
+	go func() {
+		done <- serveTCP(l, prefix, nil)
+	}()
+
+	return func() {
+		l.Close()
+		<-done
+	}
+}
+
+func TestNamedListeners(t *testing.T) {
+	listeners := []NamedListener{
+		{Name: "internal", Addr: "127.0.0.1:0"},
+		{Name: "external", Addr: "127.0.0.1:0"},
+	}
+
+	for _, nl := range listeners {
+		l, err := net.Listen("tcp", nl.Addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer startTCP(l, nl.Prefix())()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.Write([]byte("requests:1|c\n"))
+		conn.Close()
+
+		select {
+		case m := <-In:
+			if want := nl.Name + ".requests"; m.Bucket != want {
+				t.Errorf("listener %s: got bucket %q, want %q",
+					nl.Name, m.Bucket, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("listener %s: timed out waiting for metric", nl.Name)
+		}
+	}
+}
+
+func TestParseListenAddrs(t *testing.T) {
+	got, err := parseListenAddrs("127.0.0.1:8125, [::1]:8125,:8126")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []NamedListener{
+		{Addr: "127.0.0.1:8125"},
+		{Addr: "[::1]:8125"},
+		{Addr: ":8126"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseListenAddrs: got %+v, want %+v", got, want)
+	}
+
+	if got[0].Prefix() != "" {
+		t.Errorf("Prefix of an unnamed listener: got %q, want \"\"", got[0].Prefix())
+	}
+
+	for _, s := range []string{"8125", "::1:8125", "127.0.0.1"} {
+		if _, err := parseListenAddrs(s); err == nil {
+			t.Errorf("parseListenAddrs(%q): expected error", s)
+		}
+	}
+}
+
+func TestListenMultipleUDP(t *testing.T) {
+	listeners, err := parseListenAddrs("127.0.0.1:0,[::1]:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, l := range listeners {
+		addr, err := net.ResolveUDPAddr("udp", l.Addr)
+
+		if err != nil {
+			t.Fatalf("ResolveUDPAddr(%q): %v", l.Addr, err)
+		}
+
+		sock, err := net.ListenUDP("udp", addr)
+
+		if err != nil {
+			if addr.IP.To4() == nil {
+				t.Logf("skipping %s: %v", l.Addr, err)
+				continue
+			}
+
+			t.Fatal(err)
+		}
+
+		go serveUDP(sock, l.Prefix())
+		conn, err := net.Dial("udp", sock.LocalAddr().String())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.Write([]byte("multi:1|c"))
+		conn.Close()
+
+		select {
+		case m := <-In:
+			if m.Bucket != "multi" {
+				t.Errorf("listener %s: got bucket %q, want multi", l.Addr, m.Bucket)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("listener %s: timed out waiting for metric", l.Addr)
+		}
+	}
+}
+
+func TestRecvBytes(t *testing.T) {
+	defer func(m map[string]bool) { internalStats = m }(internalStats)
+	internalStats = map[string]bool{"bytes.recv.udp": true, "bytes.recv.tcp": true}
+	atomic.StoreUint64(&stats.RecvBytesUDP, 0)
+	atomic.StoreUint64(&stats.RecvBytesTCP, 0)
+
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sock.Close()
+	go serveUDP(sock, "")
+
+	conn, err := net.Dial("udp", sock.LocalAddr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 + 14 bytes over UDP
+	for _, msg := range []string{"a:1|c", "bb:2|c\nccc:3|c"} {
+		conn.Write([]byte(msg))
+	}
+
+	conn.Close()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-In:
+		case <-time.After(5 * time.Second):
+			t.Fatal("serveUDP: timed out waiting for metrics")
+		}
+	}
+
+	// 12 bytes over TCP, the last line unterminated
+	client, server := net.Pipe()
+	done := make(chan bool)
+
+	go func() {
+		handleConnection(server, "")
+		done <- true
+	}()
+
+	client.Write([]byte("a:1|c\nbb:2|c"))
+	client.Close()
+	<-done
+
+	for len(In) > 0 {
+		<-In
+	}
+
+	var buf bytes.Buffer
+	flushInternalStats(&buf, 100)
+
+	want := "statsd.bytes.recv.udp 19 100\nstatsd.bytes.recv.tcp 12 100\n"
+
+	if got := buf.String(); got != want {
+		t.Errorf("flushInternalStats: got %q, want %q", got, want)
+	}
+}
+
+func TestWriteDatagrams(t *testing.T) {
+	var packets []string
+	w := writerFunc(func(b []byte) (int, error) {
+		packets = append(packets, string(b))
+		return len(b), nil
+	})
+
+	n, err := writeDatagrams(w, []byte("aaaa\nbbbb\ncccccccccccc\ndd\nee"), 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"aaaa\nbbbb\n", "cccccccccccc\n", "dd\nee"}
+
+	if !reflect.DeepEqual(packets, want) || n != 28 {
+		t.Errorf("writeDatagrams: got %q (%d bytes), want %q (28 bytes)",
+			packets, n, want)
+	}
+}
+
+// writerFunc is an io.Writer that calls a function for each write
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
+
+func TestSendGraphiteTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	// Accept the connection but never read from it
+	go func() {
+		conn, err := l.Accept()
+
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	defer func(addr string, d time.Duration) {
+		*graphite = addr
+		*graphiteTimeout = d
+	}(*graphite, *graphiteTimeout)
+
+	*graphite = l.Addr().String()
+	*graphiteTimeout = 100 * time.Millisecond
+
+	// Enough data to fill the socket buffers on both ends
+	buf := bytes.NewBuffer(bytes.Repeat([]byte("some.bucket 1 1700000000\n"), 1<<20))
+	done := make(chan bool)
+
+	go func() {
+		sendGraphite(buf)
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("sendGraphite: blocked on a Graphite that doesn't read")
+	}
+}
+
+func TestSendGraphiteCompress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	received := make(chan []byte)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err != nil {
+			received <- nil
+			return
+		}
+
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		received <- b
+	}()
+
+	defer func(addr string, compress bool) {
+		*graphite = addr
+		*graphiteCompress = compress
+	}(*graphite, *graphiteCompress)
+
+	*graphite = l.Addr().String()
+	*graphiteCompress = true
+
+	want := strings.Repeat("some.bucket 1 1700000000\nother.bucket 2.5 1700000000\n", 1000)
+	sendGraphite(bytes.NewBufferString(want))
+
+	var b []byte
+
+	select {
+	case b = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendGraphite: timed out")
+	}
+
+	if len(b) >= len(want) {
+		t.Errorf("sendGraphite: sent %d bytes for %d bytes of metrics", len(b), len(want))
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(zr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != want {
+		t.Errorf("sendGraphite: decompressed %d bytes, want %d bytes", len(got), len(want))
+	}
+}
+
+func TestSplitFlush(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	received := make(chan string)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			received <- string(b)
+		}
+	}()
+
+	defer func(addr string, split, noInternal bool) {
+		*graphite = addr
+		*splitFlush = split
+		*noInternalStats = noInternal
+	}(*graphite, *splitFlush, *noInternalStats)
+
+	*graphite = l.Addr().String()
+	*splitFlush = true
+	*noInternalStats = true
+	resetMetrics()
+	defer resetMetrics()
+
+	processMetric(&Metric{Bucket: "hits", CountValue: 1, Type: Counter})
+	processMetric(&Metric{Bucket: "depth", Value: 2, Type: Gauge})
+	processMetric(&Metric{Bucket: "db.query", Value: 3, Type: Timer})
+
+	// Empty sections, here distributions and internal, aren't sent
+	go flushMetrics(flushSections)
+
+	want := []string{"hits ", "depth ", "db.query.count "}
+
+	for i, prefix := range want {
+		select {
+		case got := <-received:
+			if !strings.HasPrefix(got, prefix) {
+				t.Errorf("send %d: got %q, want it to start with %q", i, got, prefix)
+			}
+
+			for j, other := range want {
+				if j != i && strings.Contains(got, "\n"+other) {
+					t.Errorf("send %d: %q sent with another section", i, other)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("flushMetrics: timed out waiting for send %d", i)
+		}
+	}
+
+	select {
+	case got := <-received:
+		t.Errorf("flushMetrics: unexpected fourth send %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSendGraphiteUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pc.Close()
+
+	defer func(addr string, udp bool) {
+		*graphite = addr
+		*graphiteUDP = udp
+	}(*graphite, *graphiteUDP)
+
+	*graphite = pc.LocalAddr().String()
+	*graphiteUDP = true
+
+	var want bytes.Buffer
+
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&want, "some.bucket.name%d %d 1700000000\n", i, i)
+	}
+
+	sendGraphite(bytes.NewBuffer(want.Bytes()))
+
+	var got bytes.Buffer
+	packet := make([]byte, 65536)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for got.Len() < want.Len() {
+		n, _, err := pc.ReadFrom(packet)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n > maxDatagramSize || packet[n-1] != '\n' {
+			t.Errorf("sendGraphite: got %d byte datagram ending in %q",
+				n, packet[n-1])
+		}
+
+		got.Write(packet[:n])
+	}
+
+	if got.String() != want.String() {
+		t.Errorf("sendGraphite: got %q, want %q", got.String(), want.String())
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	defer func(d time.Duration) { *tcpIdleTimeout = d }(*tcpIdleTimeout)
+	*tcpIdleTimeout = 50 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer startTCP(l, "")()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	// A client that sends in time stays connected
+	time.Sleep(30 * time.Millisecond)
+	conn.Write([]byte("active:1|c\n"))
+
+	select {
+	case m := <-In:
+		if m.Bucket != "active" {
+			t.Errorf("idle timeout: got %+v, want active", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle timeout: connection closed before the timeout")
+	}
+
+	// Once idle, the server closes the connection
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle timeout: got %v, want EOF", err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("idle timeout: connection closed after %s", d)
+	}
+}
+
+func TestHandleConnectionFraming(t *testing.T) {
+	client, server := net.Pipe()
+	done := make(chan bool)
+
+	go func() {
+		handleConnection(server, "")
+		done <- true
+	}()
+
+	// Metrics split mid-line and across writes, ending without a newline
+	for _, chunk := range []string{"a:1", "|c", "\nb:", "2|c\n", "c:3|c\nd", ":4|c"} {
+		client.Write([]byte(chunk))
+	}
+
+	client.Close()
+	<-done
+
+	var got []string
+
+	for len(In) > 0 {
+		m := <-In
+		got = append(got, fmt.Sprintf("%s:%d", m.Bucket, m.CountValue))
+	}
+
+	want := []string{"a:1", "b:2", "c:3", "d:4"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("handleConnection: got %v, want %v", got, want)
+	}
+}
+
+func TestHandleConnectionPrefixHandshake(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"PREFIX tenant42.\na:1|c\nb:2|c\n", []string{"tcp.tenant42.a:1", "tcp.tenant42.b:2"}},
+		{"a:1|c\nPREFIX tenant42.\nb:2|c\n", []string{"tcp.a:1", "tcp.b:2"}},
+		{"PREFIX bad/prefix\na:1|c\n", nil},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		done := make(chan bool)
+
+		go func() {
+			handleConnection(server, "tcp.")
+			done <- true
+		}()
+
+		// The connection may be closed before all of the input is read
+		go func() {
+			client.Write([]byte(tt.input))
+			client.Close()
+		}()
+
+		<-done
+
+		var got []string
+
+		for len(In) > 0 {
+			m := <-In
+			got = append(got, fmt.Sprintf("%s:%d", m.Bucket, m.CountValue))
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("handleConnection(%q): got %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	defer func(n int) { *maxLineLength = n }(*maxLineLength)
+	*maxLineLength = 1024
+
+	client, server := net.Pipe()
+	done := make(chan bool)
+	before := atomic.LoadUint64(&stats.InvalidMetrics)
+
+	go func() {
+		handleConnection(server, "")
+		done <- true
+	}()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	allocated := mem.TotalAlloc
+
+	// Send a 10 MB line followed by a valid metric
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), 64*1024)
+
+		for sent := 0; sent < 10<<20; sent += len(chunk) {
+			client.Write(chunk)
+		}
+
+		client.Write([]byte("\nok:1|c\n"))
+		client.Close()
+	}()
+
+	select {
+	case m := <-In:
+		if m.Bucket != "ok" {
+			t.Errorf("handleConnection: got %+v, want ok", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConnection: metric after long line not received")
+	}
+
+	<-done
+	runtime.ReadMemStats(&mem)
+
+	if got := atomic.LoadUint64(&stats.InvalidMetrics) - before; got != 1 {
+		t.Errorf("InvalidMetrics: got %d new, want 1", got)
+	}
+
+	if n := mem.TotalAlloc - allocated; n > 4<<20 {
+		t.Errorf("handleConnection: allocated %d bytes for a 10 MB line", n)
+	}
+}
+
+func TestMaxLineLengthExact(t *testing.T) {
+	defer func(n int) { *maxLineLength = n }(*maxLineLength)
+	*maxLineLength = 16
+
+	client, server := net.Pipe()
+	done := make(chan bool)
+
+	go func() {
+		handleConnection(server, "")
+		done <- true
+	}()
+
+	// A line of exactly -max-line-length bytes is kept, one byte more is
+	// dropped
+	go func() {
+		client.Write([]byte("exactly.16.b:1|c\nexactly.17.bb:1|c\nok:1|c\n"))
+		client.Close()
+	}()
+
+	for _, want := range []string{"exactly.16.b", "ok"} {
+		select {
+		case m := <-In:
+			if m.Bucket != want {
+				t.Errorf("handleConnection: got %q, want %q", m.Bucket, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handleConnection: %q not received", want)
+		}
+	}
+
+	<-done
+}
+
+func TestDryRun(t *testing.T) {
+	defer func(addr string, b bool) {
+		*graphite = addr
+		*dryRun = b
+	}(*graphite, *dryRun)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	dialed := make(chan bool, 1)
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+			dialed <- true
+		}
+	}()
+
+	*graphite = l.Addr().String()
+	*dryRun = true
+	resetMetrics()
+	processMetric(&Metric{Bucket: "mycounter", CountValue: 1, Type: Counter})
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	flushMetrics(flushSections)
+	log.SetOutput(os.Stderr)
+
+	select {
+	case <-dialed:
+		t.Error("flushMetrics: connected to Graphite in dry-run mode")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if !strings.Contains(logged.String(), "mycounter 1 ") {
+		t.Errorf("flushMetrics: sample not logged in %q", logged.String())
+	}
+
+	if len(counters.m) != 0 {
+		t.Errorf("flushMetrics: counters not reset in dry-run mode: %v", counters.m)
+	}
+}
+
+func TestRejectionCauses(t *testing.T) {
+	defer func(b *BucketFilter) { bucketBlocklist = b }(bucketBlocklist)
+	defer func(c chan *Metric) { In = c }(In)
+	defer func(m map[string]bool) { internalStats = m }(internalStats)
+	internalStats = map[string]bool{"metrics.invalid": true, "metrics.filtered": true, "queue.dropped": true}
+	bucketBlocklist, _ = parseBucketFilter(strings.NewReader("blocked.*"))
+
+	var buf bytes.Buffer
+	flushInternalStats(&buf, 0)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"bad:x|c\nnot a metric", "statsd.queue.dropped 0 100\n" +
+			"statsd.metrics.invalid 2 100\nstatsd.metrics.filtered 0 100\n"},
+		{"blocked.a:1|c", "statsd.queue.dropped 0 100\n" +
+			"statsd.metrics.invalid 0 100\nstatsd.metrics.filtered 1 100\n"},
+		// Nothing reads from In, so a valid metric can't be queued
+		{"ok:1|c", "statsd.queue.dropped 1 100\n" +
+			"statsd.metrics.invalid 0 100\nstatsd.metrics.filtered 0 100\n"},
+	}
+
+	In = make(chan *Metric)
+
+	for _, tt := range tests {
+		handleMessage([]byte(tt.input), nil, "")
+		buf.Reset()
+		flushInternalStats(&buf, 100)
+
+		if got := buf.String(); got != tt.want {
+			t.Errorf("handleMessage(%q): got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestFastCounters(t *testing.T) {
+	defer func(f bool) { *fastCounters = f }(*fastCounters)
+	*fastCounters = true
+	resetMetrics()
+
+	// Counters bypass In; other types still go through it
+	got := collectMetrics([]byte("a:1|c\nb:2|c|@0.5\na:3|c\ng:4|g\nbad:x|c"), nil)
+
+	if len(got) != 1 || got[0].Bucket != "g" {
+		t.Errorf("handleMessage: got %d queued metrics, want only g", len(got))
+	}
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, 100, flushSections)
+
+	for _, want := range []string{"a 4 100\n", "b 4 100\n", "statsd.metrics.invalid 1 100\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("writeMetrics: %q not found in %q", want, buf.String())
+		}
+	}
+}
+
+func TestFastCountersLimits(t *testing.T) {
+	defer func(f, r bool, n int) {
+		*fastCounters, *reportSampleRate, *maxBuckets = f, r, n
+	}(*fastCounters, *reportSampleRate, *maxBuckets)
+	*fastCounters, *reportSampleRate, *maxBuckets = true, true, 1
+	resetMetrics()
+
+	collectMetrics([]byte("a:1|c|@0.5\na:1|c|@0.5\nb:1|c|@0.5\nb:1|c|@0.5"), nil)
+	mergeCounterShards()
+
+	// The shards merge in no particular order, so either bucket may be kept
+	if len(counters.m) != 1 {
+		t.Errorf("counters: got %v, want one bucket", counters.m)
+	}
+
+	for k, v := range counters.m {
+		if v != 4 || counters.rates[k] != 0.5 {
+			t.Errorf("counters: got %v with rates %v, want 4 at rate 0.5",
+				counters.m, counters.rates)
+		}
+	}
+
+	if stats.CardinalityDropped != 2 {
+		t.Errorf("CardinalityDropped: got %d, want 2", stats.CardinalityDropped)
+	}
+}
+
+func BenchmarkFlushCounters10k(b *testing.B) {
+	keys := make([]string, 10000)
+
+	for i := range keys {
+		keys[i] = fmt.Sprintf("some.counter.bucket%d", i)
+	}
+
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		counters.Lock()
+
+		for i, k := range keys {
+			counters.m[k] = int64(i)
+		}
+
+		counters.Unlock()
+		buf.Reset()
+		b.StartTimer()
+
+		flushCounters(&buf, 1700000000)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "io"
+
+// runStdin aggregates newline separated metrics read from r until EOF, then
+// flushes them once and waits for any background sends (see -stdin).
+// Metrics go through the same parser as the listeners but are aggregated
+// directly rather than through In, so a large input can't overflow the
+// queue.
+func runStdin(r io.Reader) error {
+	if err := ingestLines(r); err != nil {
+		return err
+	}
+
+	flushMetrics(flushSections)
+	asyncSends.Wait()
+	return nil
+}
+
+// ingestLines ingests newline separated metrics read from r until EOF.
+// Lines longer than -max-line-length are counted as invalid, as they are
+// on a TCP connection.
+func ingestLines(r io.Reader) error {
+	br := newLineReader(r)
+
+	for {
+		line, tooLong, err := readLine(br)
+
+		if tooLong {
+			countInvalid(nil)
+		} else if len(line) > 0 {
+			ingest(line)
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ingest adds the newline separated metrics in buf to the aggregates. It
+// bypasses the listeners and the In channel, so metrics are aggregated
+// before it returns and no processMetrics goroutine is needed.
+func ingest(buf []byte) {
+	parseMessage(buf, nil, "", processMetric)
+}
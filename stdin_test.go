@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunStdin(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	received := make(chan string)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		received <- string(b)
+	}()
+
+	defer func(addr string, b bool) {
+		*graphite = addr
+		*noInternalStats = b
+	}(*graphite, *noInternalStats)
+
+	*graphite = l.Addr().String()
+	*noInternalStats = true
+	resetMetrics()
+
+	// The last line has no newline
+	input := "piped:1|c\npiped:2|c\n\nlevel:7|g\npiped:4|c"
+
+	if err := runStdin(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		for _, want := range []string{"piped 7 ", "level 7 "} {
+			if !strings.Contains(got, want) {
+				t.Errorf("runStdin: %q not found in %q", want, got)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runStdin: timed out waiting for flush")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// errSyslogHeader is returned for a message without a valid syslog header
+var errSyslogHeader = errors.New("invalid syslog header")
+
+// syslogBOM may start the message of an RFC5424 syslog line
+var syslogBOM = []byte("\xef\xbb\xbf")
+
+// stripSyslogHeader removes the syslog header from a message received with
+// -syslog and returns the payload. Both RFC5424 headers
+//
+//	<134>1 2024-01-02T15:04:05Z web01 app 123 - - api.requests:1|c
+//
+// and RFC3164 headers
+//
+//	<134>Jan  2 15:04:05 web01 app[123]: api.requests:1|c
+//
+// are accepted. The RFC3164 hostname and tag are optional, since local
+// senders often leave out the hostname and a tag is only recognized by its
+// trailing colon.
+func stripSyslogHeader(buf []byte) ([]byte, error) {
+	buf = bytes.TrimSpace(buf)
+	rest, ok := syslogPriority(buf)
+
+	if !ok {
+		return nil, errSyslogHeader
+	}
+
+	if msg, ok := stripRFC5424(rest); ok {
+		return msg, nil
+	}
+
+	return stripRFC3164(rest), nil
+}
+
+// syslogPriority strips the <PRI> that starts every syslog message
+func syslogPriority(buf []byte) ([]byte, bool) {
+	if len(buf) < 3 || buf[0] != '<' {
+		return nil, false
+	}
+
+	i := bytes.IndexByte(buf, '>')
+
+	if i < 2 || i > 4 || !isDigits(buf[1:i]) {
+		return nil, false
+	}
+
+	return buf[i+1:], true
+}
+
+// stripRFC5424 strips the fields following the priority of an RFC5424
+// header: VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA.
+// It reports false if buf doesn't start with a version.
+func stripRFC5424(buf []byte) ([]byte, bool) {
+	version, rest := nextField(buf)
+
+	if len(version) == 0 || len(version) > 2 || !isDigits(version) {
+		return nil, false
+	}
+
+	// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	for i := 0; i < 5; i++ {
+		_, rest = nextField(rest)
+	}
+
+	rest = skipStructuredData(rest)
+	rest = bytes.TrimPrefix(bytes.TrimLeft(rest, " "), syslogBOM)
+	return rest, true
+}
+
+// skipStructuredData skips the RFC5424 STRUCTURED-DATA field, which is
+// either - or one or more [elements]. A ] inside a quoted param value is
+// escaped with a backslash.
+func skipStructuredData(buf []byte) []byte {
+	if len(buf) > 0 && buf[0] == '-' {
+		return buf[1:]
+	}
+
+	for len(buf) > 0 && buf[0] == '[' {
+		i := 1
+
+		for i < len(buf) && buf[i] != ']' {
+			if buf[i] == '\\' {
+				i++
+			}
+
+			i++
+		}
+
+		if i >= len(buf) {
+			return nil
+		}
+
+		buf = buf[i+1:]
+	}
+
+	return buf
+}
+
+// stripRFC3164 strips the optional TIMESTAMP, HOSTNAME and TAG following the
+// priority of an RFC3164 header
+func stripRFC3164(buf []byte) []byte {
+	if len(buf) > len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, string(buf[:len(time.Stamp)])); err == nil {
+			buf = bytes.TrimLeft(buf[len(time.Stamp):], " ")
+		}
+	}
+
+	// Either "tag: msg", "host tag: msg" or "host msg". Metrics contain a
+	// colon but never end a field with one.
+	field, rest := nextField(buf)
+
+	switch {
+	case bytes.HasSuffix(field, []byte(":")):
+		return rest
+	case bytes.Contains(field, []byte("|")):
+		return buf
+	}
+
+	if tag, msg := nextField(rest); bytes.HasSuffix(tag, []byte(":")) {
+		return msg
+	}
+
+	return rest
+}
+
+// nextField splits the first space separated field from buf
+func nextField(buf []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(buf, ' ')
+
+	if i < 0 {
+		return buf, nil
+	}
+
+	return buf[:i], bytes.TrimLeft(buf[i+1:], " ")
+}
+
+// isDigits reports whether b is all ASCII digits
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return len(b) > 0
+}
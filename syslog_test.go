@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripSyslogHeader(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		// RFC5424
+		{"<134>1 2024-01-02T15:04:05.123Z web01 app 123 ID47 - api.requests:1|c",
+			"api.requests:1|c"},
+		{"<134>1 - - - - - - api.requests:1|c", "api.requests:1|c"},
+		{`<165>1 2024-01-02T15:04:05Z web01 app - - [exampleSDID@32473 iut="3" eventSource="a \] b"][meta x="1"] api.requests:1|c`,
+			"api.requests:1|c"},
+		{"<134>1 2024-01-02T15:04:05Z web01 app - - - \xef\xbb\xbfapi.latency:12|ms\napi.requests:1|c",
+			"api.latency:12|ms\napi.requests:1|c"},
+
+		// RFC3164
+		{"<134>Jan  2 15:04:05 web01 app[123]: api.requests:1|c", "api.requests:1|c"},
+		{"<134>Jan 12 15:04:05 app: api.requests:1|c", "api.requests:1|c"},
+		{"<134>Jan  2 15:04:05 web01 api.requests:1|c", "api.requests:1|c"},
+		{"<134>app[123]: api.requests:1|c\napi.errors:2|c", "api.requests:1|c\napi.errors:2|c"},
+		{"<13>api.requests:1|c", "api.requests:1|c"},
+	}
+
+	for _, tt := range tests {
+		got, err := stripSyslogHeader([]byte(tt.input))
+
+		if err != nil {
+			t.Errorf("stripSyslogHeader(%q): %s", tt.input, err)
+			continue
+		}
+
+		if string(got) != tt.want {
+			t.Errorf("stripSyslogHeader(%q): got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestStripSyslogHeaderInvalid(t *testing.T) {
+	for _, input := range []string{"api.requests:1|c", "<>api.requests:1|c", "<12345>x", "<1a>x"} {
+		if _, err := stripSyslogHeader([]byte(input)); err == nil {
+			t.Errorf("stripSyslogHeader(%q): expected error", input)
+		}
+	}
+}
+
+func TestHandleMessageSyslog(t *testing.T) {
+	defer func(v bool) { *syslogMode = v }(*syslogMode)
+	*syslogMode = true
+
+	metrics := collectMetrics([]byte("<134>1 2024-01-02T15:04:05Z web01 app 123 - - "+
+		"api.requests:1|c\napi.latency:12|ms\n"), nil)
+
+	var got []string
+
+	for _, m := range metrics {
+		got = append(got, m.Bucket)
+	}
+
+	if want := "api.requests api.latency"; strings.Join(got, " ") != want {
+		t.Errorf("handleMessage: got %q, want %q", got, want)
+	}
+
+	// A message without a header is rejected as a whole
+	defer func(n uint64) { stats.InvalidMetrics = n }(stats.InvalidMetrics)
+	stats.InvalidMetrics = 0
+
+	if metrics := collectMetrics([]byte("api.requests:1|c"), nil); len(metrics) != 0 {
+		t.Errorf("handleMessage without header: got %d metrics, want 0", len(metrics))
+	}
+
+	if stats.InvalidMetrics != 1 {
+		t.Errorf("handleMessage without header: got %d invalid, want 1", stats.InvalidMetrics)
+	}
+}
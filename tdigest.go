@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+// TDigest is a merging t-digest (Dunning & Ertl) that estimates quantiles of
+// a stream of values in bounded memory. Values are buffered and merged into
+// weighted centroids whose size is limited by their quantile, so centroids
+// near the tails stay small and the tail percentiles stay accurate.
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	buf         []centroid
+	count       float64
+	sum         float64
+	min         float64
+	max         float64
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// defaultCompression is the compression of timer digests. A digest of n
+// values holds on the order of compression*log(n) centroids.
+const defaultCompression = 100
+
+// NewTDigest returns an empty digest. Higher compression is more accurate
+// but uses more memory.
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{compression: compression}
+}
+
+// Add adds a value to the digest
+func (d *TDigest) Add(v float64) {
+	if d.count == 0 || v < d.min {
+		d.min = v
+	}
+
+	if d.count == 0 || v > d.max {
+		d.max = v
+	}
+
+	d.count++
+	d.sum += v
+	d.buf = append(d.buf, centroid{v, 1})
+
+	if len(d.buf) >= int(5*d.compression) {
+		d.compress()
+	}
+}
+
+// Merge adds the values summarized by another digest
+func (d *TDigest) Merge(o *TDigest) {
+	if o.count == 0 {
+		return
+	}
+
+	if d.count == 0 || o.min < d.min {
+		d.min = o.min
+	}
+
+	if d.count == 0 || o.max > d.max {
+		d.max = o.max
+	}
+
+	d.count += o.count
+	d.sum += o.sum
+	d.buf = append(d.buf, o.centroids...)
+	d.buf = append(d.buf, o.buf...)
+
+	if len(d.buf) >= int(5*d.compression) {
+		d.compress()
+	}
+}
+
+// tdigestJSON is the form a TDigest is saved in by -wal-path. Each centroid
+// is a [mean, weight] pair.
+type tdigestJSON struct {
+	Compression float64      `json:"compression"`
+	Centroids   [][2]float64 `json:"centroids"`
+	Count       float64      `json:"count"`
+	Sum         float64      `json:"sum"`
+	Min         float64      `json:"min"`
+	Max         float64      `json:"max"`
+}
+
+// MarshalJSON encodes the digest's centroids and totals. Buffered values
+// are saved as centroids of weight 1, so the digest isn't modified.
+func (d *TDigest) MarshalJSON() ([]byte, error) {
+	j := tdigestJSON{
+		Compression: d.compression,
+		Centroids:   make([][2]float64, 0, len(d.centroids)+len(d.buf)),
+		Count:       d.count,
+		Sum:         d.sum,
+		Min:         d.min,
+		Max:         d.max,
+	}
+
+	for _, cs := range [][]centroid{d.centroids, d.buf} {
+		for _, c := range cs {
+			j.Centroids = append(j.Centroids, [2]float64{c.mean, c.weight})
+		}
+	}
+
+	return json.Marshal(&j)
+}
+
+// UnmarshalJSON decodes a digest encoded by MarshalJSON
+func (d *TDigest) UnmarshalJSON(b []byte) error {
+	var j tdigestJSON
+
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+
+	if j.Compression <= 0 {
+		j.Compression = defaultCompression
+	}
+
+	*d = TDigest{
+		compression: j.Compression,
+		count:       j.Count,
+		sum:         j.Sum,
+		min:         j.Min,
+		max:         j.Max,
+	}
+
+	// The centroids are merged again on the next compress
+	for _, c := range j.Centroids {
+		d.buf = append(d.buf, centroid{c[0], c[1]})
+	}
+
+	return nil
+}
+
+// Count returns the number of values added
+func (d *TDigest) Count() float64 { return d.count }
+
+// Mean returns the mean of the values added
+func (d *TDigest) Mean() float64 { return d.sum / d.count }
+
+// Min returns the smallest value added
+func (d *TDigest) Min() float64 { return d.min }
+
+// Max returns the largest value added
+func (d *TDigest) Max() float64 { return d.max }
+
+// compress merges the buffered values into the centroids
+func (d *TDigest) compress() {
+	if len(d.buf) == 0 {
+		return
+	}
+
+	all := append(d.buf, d.centroids...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, len(d.centroids)+1)
+	cur := all[0]
+	var cum float64
+
+	for _, c := range all[1:] {
+		w := cur.weight + c.weight
+		q := (cum + w/2) / d.count
+
+		// The size bound 4nq(1-q)/compression keeps the tails fine-grained
+		if w <= 4*d.count*q*(1-q)/d.compression {
+			cur.mean += (c.mean - cur.mean) * c.weight / w
+			cur.weight = w
+			continue
+		}
+
+		merged = append(merged, cur)
+		cum += cur.weight
+		cur = c
+	}
+
+	d.centroids = append(merged, cur)
+	d.buf = d.buf[:0]
+}
+
+// Quantile returns the estimated value at quantile q (0 to 1), interpolating
+// between the centers of neighbouring centroids
+func (d *TDigest) Quantile(q float64) float64 {
+	d.compress()
+
+	if d.count == 0 {
+		return math.NaN()
+	}
+
+	target := q * d.count
+	prevMean, prevPos := d.min, 0.0
+	var cum float64
+
+	for _, c := range d.centroids {
+		pos := cum + c.weight/2
+
+		if target < pos {
+			if pos == prevPos {
+				return c.mean
+			}
+
+			return prevMean + (c.mean-prevMean)*(target-prevPos)/(pos-prevPos)
+		}
+
+		prevMean, prevPos = c.mean, pos
+		cum += c.weight
+	}
+
+	if d.count == prevPos {
+		return d.max
+	}
+
+	return prevMean + (d.max-prevMean)*(target-prevPos)/(d.count-prevPos)
+}
+
+// TrimmedMean returns the estimated mean of the values at or below
+// quantile q
+func (d *TDigest) TrimmedMean(q float64) float64 {
+	d.compress()
+	target := q * d.count
+	var sum, weight float64
+
+	for _, c := range d.centroids {
+		w := math.Min(c.weight, target-weight)
+
+		if w <= 0 {
+			break
+		}
+
+		sum += c.mean * w
+		weight += w
+	}
+
+	if weight == 0 {
+		return d.min
+	}
+
+	return sum / weight
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTDigestQuantile(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	d := NewTDigest(defaultCompression)
+	values := make(Timers, 100000)
+
+	for i := range values {
+		// Skewed like real latencies
+		values[i] = r.ExpFloat64() * 100
+		d.Add(values[i])
+	}
+
+	sort.Sort(values)
+
+	for _, pct := range []float64{5, 50, 95, 99} {
+		exact := perc(values, pct)
+		got := d.Quantile(pct / 100)
+
+		if math.Abs(got-exact)/exact > 0.02 {
+			t.Errorf("Quantile(%v): got %f, exact %f", pct/100, got, exact)
+		}
+	}
+
+	if d.Min() != values[0] || d.Max() != values[len(values)-1] {
+		t.Errorf("Min/Max: got %f/%f, want %f/%f", d.Min(), d.Max(),
+			values[0], values[len(values)-1])
+	}
+
+	// Memory stays bounded: 100,000 values fit in under 1,000 centroids
+	if n := len(d.centroids); n > 1000 {
+		t.Errorf("centroids: got %d for %d values", n, len(values))
+	}
+}
+
+func TestFlushTimersTDigest(t *testing.T) {
+	defer func(s string) { *timerAlgorithm = s }(*timerAlgorithm)
+	defer setPercentiles(Percentiles())
+	*timerAlgorithm = "tdigest"
+	setPercentiles([]float64{95})
+	resetMetrics()
+
+	for i := 1; i <= 1000; i++ {
+		processMetric(&Metric{Bucket: "mytimer", Value: float64(i), Type: Timer,
+			SampleRate: 1})
+	}
+
+	if len(timers.m["mytimer"]) != 0 {
+		t.Errorf("tdigest: %d values stored, want 0", len(timers.m["mytimer"]))
+	}
+
+	var buf bytes.Buffer
+	n := flushTimers(&buf, 100)
+
+	for _, want := range []string{
+		"mytimer.count 1000 100\n",
+		"mytimer.mean 500.500000 100\n",
+		"mytimer.lower 1.000000 100\n",
+		"mytimer.upper 1000.000000 100\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("flushTimers: %q not found in %q", want, buf.String())
+		}
+	}
+
+	// The exact nearest-rank p95 of 1..1000 is 950
+	var p95 float64
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		fmt.Sscanf(line, "mytimer.perc95 %f", &p95)
+	}
+
+	if math.Abs(p95-950) > 5 {
+		t.Errorf("flushTimers: perc95 %f, want within 5 of 950", p95)
+	}
+
+	if n != 8 {
+		t.Errorf("flushTimers: got n=%d, want 8", n)
+	}
+
+	if len(timers.digests) != 0 {
+		t.Errorf("flushTimers: digests not cleared: %v", timers.digests)
+	}
+}
+
+func TestTDigestMerge(t *testing.T) {
+	a, b := NewTDigest(defaultCompression), NewTDigest(defaultCompression)
+
+	for i := 1; i <= 50; i++ {
+		a.Add(float64(i))
+		b.Add(float64(i + 50))
+	}
+
+	a.Merge(b)
+
+	if a.Count() != 100 || a.Min() != 1 || a.Max() != 100 || a.Mean() != 50.5 {
+		t.Errorf("Merge: got count %v min %v max %v mean %v, want 100 1 100 50.5",
+			a.Count(), a.Min(), a.Max(), a.Mean())
+	}
+}
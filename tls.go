@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// checkTLSFlags checks that the TCP listener's TLS flags are set together.
+// A certificate without its key, or a client CA without both, would
+// otherwise leave the listener serving plaintext.
+func checkTLSFlags(certFile, keyFile, clientCA string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+
+	if clientCA != "" && certFile == "" {
+		return fmt.Errorf("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+
+	return nil
+}
+
+// serverTLSConfig loads the certificate and key for a TLS listener. If
+// clientCA is set, clients must present a certificate signed by it.
+func serverTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// loadCertPool reads a PEM encoded CA bundle
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to dir, returning the file names
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestListenTCPTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := writeTestCert(t, dir, "server")
+	clientCert, clientKey := writeTestCert(t, dir, "client")
+
+	cfg, err := serverTLSConfig(serverCert, serverKey, clientCert)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer startTCP(l, "")()
+
+	roots, err := loadCertPool(serverCert)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{cert},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Write([]byte("tlscounter:3|c\n"))
+	conn.Close()
+
+	select {
+	case m := <-In:
+		if m.Bucket != "tlscounter" || m.CountValue != 3 {
+			t.Errorf("TLS listener: got %+v, want tlscounter 3", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TLS listener: timed out waiting for metric")
+	}
+
+	// Clients without a certificate are rejected
+	conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots})
+
+	if err == nil {
+		conn.Write([]byte("anon:1|c\n"))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	if err == nil {
+		t.Error("TLS listener: expected client without certificate to be rejected")
+	}
+}
+
+func TestCheckTLSFlags(t *testing.T) {
+	tests := []struct {
+		cert, key, clientCA string
+		ok                  bool
+	}{
+		{"", "", "", true},
+		{"cert.pem", "key.pem", "", true},
+		{"cert.pem", "key.pem", "ca.pem", true},
+		{"cert.pem", "", "", false},
+		{"", "key.pem", "", false},
+		{"", "", "ca.pem", false},
+		{"cert.pem", "", "ca.pem", false},
+	}
+
+	for _, tt := range tests {
+		err := checkTLSFlags(tt.cert, tt.key, tt.clientCA)
+
+		if (err == nil) != tt.ok {
+			t.Errorf("checkTLSFlags(%q, %q, %q): got %v, want ok=%v",
+				tt.cert, tt.key, tt.clientCA, err, tt.ok)
+		}
+	}
+}
+
+func TestSendGraphiteTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "graphite")
+	cfg, err := serverTLSConfig(certFile, keyFile, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	received := make(chan string)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		received <- string(b)
+	}()
+
+	defer func(addr string, tls, skip bool) {
+		*graphite = addr
+		*graphiteTLS = tls
+		*graphiteTLSSkipVerify = skip
+	}(*graphite, *graphiteTLS, *graphiteTLSSkipVerify)
+
+	*graphite = l.Addr().String()
+	*graphiteTLS = true
+	*graphiteTLSSkipVerify = true
+
+	want := "foo 1 100\nbar 2 100\n"
+	sendGraphite(bytes.NewBufferString(want))
+
+	select {
+	case got := <-received:
+		if got != want {
+			t.Errorf("sendGraphite over TLS: got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendGraphite over TLS: timed out")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// bucketUpdates counts the updates to each bucket, per metric type, since
+// the last -top-n log
+var bucketUpdates = struct {
+	sync.Mutex
+	m       map[string]map[string]uint64
+	flushes int
+}{m: make(map[string]map[string]uint64)}
+
+// topNTypes is the order metric types are logged in by logTopBuckets
+var topNTypes = []struct {
+	typ  string
+	name string
+}{
+	{Counter, "counters"},
+	{Gauge, "gauges"},
+	{Timer, "timers"},
+	{Distribution, "distributions"},
+}
+
+// bucketCount is a bucket and the number of updates it received
+type bucketCount struct {
+	Bucket  string `json:"bucket"`
+	Updates uint64 `json:"updates"`
+}
+
+func (c bucketCount) String() string {
+	return fmt.Sprintf("%s:%d", c.Bucket, c.Updates)
+}
+
+// countUpdate records an update to a bucket when -top-n is enabled
+func countUpdate(typ, bucket string) {
+	if *topN < 1 {
+		return
+	}
+
+	bucketUpdates.Lock()
+	defer bucketUpdates.Unlock()
+
+	counts, ok := bucketUpdates.m[typ]
+
+	if !ok {
+		counts = make(map[string]uint64)
+		bucketUpdates.m[typ] = counts
+	}
+
+	counts[bucket]++
+}
+
+// topBuckets returns the n buckets with the most updates, most updated
+// first. Ties are ordered by name.
+func topBuckets(counts map[string]uint64, n int) []bucketCount {
+	top := make([]bucketCount, 0, len(counts))
+
+	for k, v := range counts {
+		top = append(top, bucketCount{k, v})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Updates != top[j].Updates {
+			return top[i].Updates > top[j].Updates
+		}
+
+		return top[i].Bucket < top[j].Bucket
+	})
+
+	if len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
+
+// logTopBuckets logs the -top-n most updated buckets of each type every
+// -top-n-flushes flushes, then starts counting again
+func logTopBuckets() {
+	if *topN < 1 {
+		return
+	}
+
+	bucketUpdates.Lock()
+	defer bucketUpdates.Unlock()
+
+	if bucketUpdates.flushes++; bucketUpdates.flushes < *topNFlushes {
+		return
+	}
+
+	for _, t := range topNTypes {
+		if counts := bucketUpdates.m[t.typ]; len(counts) > 0 {
+			logEvent("stats", "Most updated buckets", "type", t.name,
+				"buckets", len(counts), "top", topBuckets(counts, *topN))
+		}
+	}
+
+	bucketUpdates.m = make(map[string]map[string]uint64)
+	bucketUpdates.flushes = 0
+}
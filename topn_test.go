@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTopBuckets(t *testing.T) {
+	defer func(n, f int) { *topN, *topNFlushes = n, f }(*topN, *topNFlushes)
+	*topN = 2
+	*topNFlushes = 2
+
+	bucketUpdates.Lock()
+	bucketUpdates.m = make(map[string]map[string]uint64)
+	bucketUpdates.flushes = 0
+	bucketUpdates.Unlock()
+
+	resetMetrics()
+	defer resetMetrics()
+
+	for bucket, n := range map[string]int{"noisy": 5, "busy": 3, "quiet": 1, "also.busy": 3} {
+		for i := 0; i < n; i++ {
+			processMetric(&Metric{Bucket: bucket, Value: 1, Type: Gauge})
+		}
+	}
+
+	processMetric(&Metric{Bucket: "hits", CountValue: 1, Type: Counter})
+
+	bucketUpdates.Lock()
+	top := topBuckets(bucketUpdates.m[Gauge], *topN)
+	bucketUpdates.Unlock()
+
+	if got, want := fmt.Sprint(top), "[noisy:5 also.busy:3]"; got != want {
+		t.Errorf("topBuckets: got %s, want %s", got, want)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	// Nothing is logged until -top-n-flushes flushes have passed
+	logTopBuckets()
+
+	if buf.Len() != 0 {
+		t.Errorf("logTopBuckets: logged after one flush: %q", buf.String())
+	}
+
+	logTopBuckets()
+
+	for _, want := range []string{
+		"type=counters buckets=1 top=[hits:1]",
+		"type=gauges buckets=4 top=[noisy:5 also.busy:3]",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("logTopBuckets: %q not found in %q", want, buf.String())
+		}
+	}
+
+	// The counts start again after each log
+	buf.Reset()
+	logTopBuckets()
+	logTopBuckets()
+
+	if buf.Len() != 0 {
+		t.Errorf("logTopBuckets: counts not reset: %q", buf.String())
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+)
+
+// runVerify ingests a fixture file and writes the resulting flush to out,
+// which is a file name or - for stdout
+func runVerify(in, out string) error {
+	r, err := os.Open(in)
+
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+	w := os.Stdout
+
+	if out != "-" {
+		w, err = os.Create(out)
+
+		if err != nil {
+			return err
+		}
+
+		defer w.Close()
+	}
+
+	return verifyBackend(r, w, time.Now().Unix())
+}
+
+// verifyBackend feeds newline separated metrics from r through the normal
+// parsing and aggregation path, flushes once and writes the exact bytes that
+// would have been sent to the backend to w. For -backend kafka that is the
+// value of each record, one per line.
+func verifyBackend(r io.Reader, w io.Writer, now int64) error {
+	if err := ingestLines(r); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, now, flushSections)
+
+	if *backend == "kafka" {
+		for _, rec := range kafkaRecords(buf.Bytes(), now) {
+			if _, err := w.Write(append(rec.Value, '\n')); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// Compressed with -graphite-compress like a flush sent to Graphite
+	_, err := writeGraphite(w, &buf)
+	return err
+}
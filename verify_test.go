@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVerifyBackend(t *testing.T) {
+	defer func(t time.Time) { startTime = t }(startTime)
+	startTime = time.Unix(1700000000, 0)
+	resetMetrics()
+
+	// Rejections counted by earlier tests would show up in the flush
+	atomic.StoreUint64(&stats.InvalidMetrics, 0)
+	atomic.StoreUint64(&stats.Filtered, 0)
+	atomic.StoreUint64(&stats.RelabelDropped, 0)
+
+	in, err := os.Open("testdata/verify.txt")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer in.Close()
+
+	var got bytes.Buffer
+
+	if err := verifyBackend(in, &got, 1700000010); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := ioutil.ReadFile("testdata/verify.golden")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("verifyBackend: output differs from testdata/verify.golden\ngot:\n%s\nwant:\n%s",
+			got.Bytes(), want)
+	}
+}
+
+func TestVerifyBackendLongLine(t *testing.T) {
+	defer func(n int) { *maxLineLength = n }(*maxLineLength)
+	*maxLineLength = 128 * 1024
+	resetMetrics()
+
+	// Lines past bufio.Scanner's 64 KB limit are read like any other
+	long := strings.Repeat("a", 100*1024)
+	in := strings.NewReader(long + ":1|c\nb:2|c\n")
+	var got bytes.Buffer
+
+	if err := verifyBackend(in, &got, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{long + " 1 100\n", "b 2 100\n"} {
+		if !strings.Contains(got.String(), want) {
+			t.Errorf("verifyBackend: missing %.20q in output", want)
+		}
+	}
+}
+
+func TestVerifyBackendEncoding(t *testing.T) {
+	defer func(b string, c, n bool) {
+		*backend, *graphiteCompress, *noInternalStats = b, c, n
+	}(*backend, *graphiteCompress, *noInternalStats)
+	*noInternalStats = true
+
+	verify := func() []byte {
+		resetMetrics()
+		var got bytes.Buffer
+
+		if err := verifyBackend(strings.NewReader("a:1|c\n"), &got, 100); err != nil {
+			t.Fatal(err)
+		}
+
+		return got.Bytes()
+	}
+
+	*backend, *graphiteCompress = "graphite", true
+	zr, err := gzip.NewReader(bytes.NewReader(verify()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := ioutil.ReadAll(zr); string(got) != "a 1 100\n" {
+		t.Errorf("-graphite-compress: got %q, want %q", got, "a 1 100\n")
+	}
+
+	*backend, *graphiteCompress = "kafka", false
+	want := `{"name":"a","value":1,"timestamp":100}` + "\n"
+
+	if got := verify(); string(got) != want {
+		t.Errorf("-backend kafka: got %q, want %q", got, want)
+	}
+}
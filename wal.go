@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Snapshot is the on-disk format used by -wal-path to carry aggregated
+// metrics across a restart
+type Snapshot struct {
+	Counters      map[string]int64   `json:"counters,omitempty"`
+	Gauges        map[string]float64 `json:"gauges,omitempty"`
+	Timers        map[string]Timers  `json:"timers,omitempty"`
+	Distributions map[string]Timers  `json:"distributions,omitempty"`
+
+	// The state kept beside the values, so a restored bucket flushes as it
+	// would have without the restart
+	CounterRates map[string]float64 `json:"counter_rates,omitempty"`
+	CounterRaw   map[string]int64   `json:"counter_raw,omitempty"`
+	GaugeTimes   map[string]int64   `json:"gauge_times,omitempty"`
+	TimerDropped map[string]int64   `json:"timer_dropped,omitempty"`
+	TimerSampled map[string]float64 `json:"timer_sampled,omitempty"`
+
+	// Timers aggregated with -timer-algorithm=tdigest
+	Digests map[string]*TDigest `json:"digests,omitempty"`
+}
+
+// saveSnapshot writes the current aggregates to path. The file is written
+// to a temporary name first so a crash never leaves a partial snapshot.
+func saveSnapshot(path string) error {
+	mergeCounterShards()
+	counters.RLock()
+	gauges.RLock()
+	timers.RLock()
+	distributions.RLock()
+
+	b, err := json.Marshal(&Snapshot{
+		Counters:      counters.m,
+		Gauges:        gauges.m,
+		Timers:        timers.m,
+		Distributions: distributions.m,
+		CounterRates:  counters.rates,
+		CounterRaw:    counters.raw,
+		GaugeTimes:    gauges.times,
+		TimerDropped:  timers.dropped,
+		TimerSampled:  timers.sampled,
+		Digests:       timers.digests,
+	})
+
+	distributions.RUnlock()
+	timers.RUnlock()
+	gauges.RUnlock()
+	counters.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".snapshot")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// loadSnapshot merges a snapshot written by saveSnapshot into the current
+// aggregates and removes it, so the same metrics are never loaded twice. A
+// missing snapshot is not an error.
+func loadSnapshot(path string) error {
+	b, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var snap Snapshot
+
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+
+	counters.Lock()
+	for k, v := range snap.Counters {
+		counters.m[k] += v
+	}
+
+	for k, v := range snap.CounterRaw {
+		counters.raw[k] += v
+	}
+
+	// A rate seen since the restart is the more recent one
+	for k, v := range snap.CounterRates {
+		if _, ok := counters.rates[k]; !ok {
+			counters.rates[k] = v
+		}
+	}
+	counters.Unlock()
+
+	gauges.Lock()
+	for k, v := range snap.Gauges {
+		gauges.m[k] = v
+		delete(gauges.times, k)
+	}
+
+	for k, t := range snap.GaugeTimes {
+		gauges.times[k] = t
+	}
+	gauges.Unlock()
+
+	timers.Lock()
+	for k, v := range snap.Timers {
+		timers.m[k] = append(timers.m[k], v...)
+	}
+
+	for k, n := range snap.TimerDropped {
+		timers.dropped[k] += n
+	}
+
+	for k, n := range snap.TimerSampled {
+		timers.sampled[k] += n
+	}
+
+	for k, d := range snap.Digests {
+		if timers.digests[k] == nil {
+			timers.digests[k] = NewTDigest(defaultCompression)
+		}
+
+		timers.digests[k].Merge(d)
+
+		// Timers are flushed by their key in timers.m
+		if _, ok := timers.m[k]; !ok {
+			timers.m[k] = nil
+		}
+	}
+	timers.Unlock()
+
+	distributions.Lock()
+	for k, v := range snap.Distributions {
+		distributions.m[k] = append(distributions.m[k], v...)
+	}
+	distributions.Unlock()
+
+	return os.Remove(path)
+}
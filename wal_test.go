@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotFastCounters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	defer func(f bool) { *fastCounters = f }(*fastCounters)
+	*fastCounters = true
+	path := filepath.Join(dir, "snapshot.json")
+
+	// Counters still held in the shards are saved too
+	resetMetrics()
+	collectMetrics([]byte("sharded:3|c"), nil)
+
+	if err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	resetMetrics()
+
+	if err := loadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]int64{"sharded": 3}; !reflect.DeepEqual(counters.m, want) {
+		t.Errorf("counters: got %v, want %v", counters.m, want)
+	}
+}
+
+func TestSnapshotTDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	defer func(s string) { *timerAlgorithm = s }(*timerAlgorithm)
+	*timerAlgorithm = "tdigest"
+	path := filepath.Join(dir, "snapshot.json")
+
+	resetMetrics()
+	defer resetMetrics()
+
+	for v := 1.0; v <= 100; v++ {
+		processMetric(&Metric{Bucket: "latency", Value: v, Type: Timer})
+	}
+
+	if err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	resetMetrics()
+	processMetric(&Metric{Bucket: "latency", Value: 101, Type: Timer})
+
+	if err := loadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	d := timers.digests["latency"]
+
+	if d == nil || d.Count() != 101 || d.Min() != 1 || d.Max() != 101 {
+		t.Fatalf("digest after restore: got %+v, want 101 values from 1 to 101", d)
+	}
+
+	if got := d.Quantile(0.5); math.Abs(got-51) > 1 {
+		t.Errorf("median after restore: got %v, want about 51", got)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	resetMetrics()
+	counters.m["mycounter"] = 5
+	counters.rates["mycounter"] = 0.5
+	counters.raw["mycounter"] = 3
+	gauges.m["mygauge"] = 1.5
+	gauges.m["oldgauge"] = 2
+	gauges.times["oldgauge"] = 1600000000
+	timers.m["mytimer"] = Timers{3, 1, 2}
+	timers.dropped["mytimer"] = 4
+	timers.sampled["mytimer"] = 1.5
+	distributions.m["mydist"] = Timers{7}
+
+	if err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Metrics received after the restart are merged with the snapshot
+	resetMetrics()
+	counters.m["mycounter"] = 1
+	counters.rates["mycounter"] = 0.25
+	counters.raw["mycounter"] = 1
+	timers.m["mytimer"] = Timers{4}
+	timers.dropped["mytimer"] = 1
+
+	if err := loadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]int64{"mycounter": 6}; !reflect.DeepEqual(counters.m, want) {
+		t.Errorf("counters: got %v, want %v", counters.m, want)
+	}
+
+	if want := map[string]int64{"mycounter": 4}; !reflect.DeepEqual(counters.raw, want) {
+		t.Errorf("counter raw counts: got %v, want %v", counters.raw, want)
+	}
+
+	if want := map[string]float64{"mycounter": 0.25}; !reflect.DeepEqual(counters.rates, want) {
+		t.Errorf("counter rates: got %v, want %v", counters.rates, want)
+	}
+
+	if want := map[string]float64{"mygauge": 1.5, "oldgauge": 2}; !reflect.DeepEqual(gauges.m, want) {
+		t.Errorf("gauges: got %v, want %v", gauges.m, want)
+	}
+
+	if want := map[string]int64{"oldgauge": 1600000000}; !reflect.DeepEqual(gauges.times, want) {
+		t.Errorf("gauge timestamps: got %v, want %v", gauges.times, want)
+	}
+
+	if want := map[string]Timers{"mytimer": {4, 3, 1, 2}}; !reflect.DeepEqual(timers.m, want) {
+		t.Errorf("timers: got %v, want %v", timers.m, want)
+	}
+
+	// The count of a sampled timer still covers what it didn't keep
+	if timers.dropped["mytimer"] != 5 || timers.sampled["mytimer"] != 1.5 {
+		t.Errorf("timer counts: got dropped %v, sampled %v, want 5 and 1.5",
+			timers.dropped["mytimer"], timers.sampled["mytimer"])
+	}
+
+	if want := map[string]Timers{"mydist": {7}}; !reflect.DeepEqual(distributions.m, want) {
+		t.Errorf("distributions: got %v, want %v", distributions.m, want)
+	}
+
+	// The snapshot is consumed so it can't be loaded twice
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("snapshot still exists after load: %v", err)
+	}
+
+	if err := loadSnapshot(path); err != nil {
+		t.Errorf("loadSnapshot with no snapshot: %s", err)
+	}
+
+	resetMetrics()
+}
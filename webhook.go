@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultWebhookTemplate renders a flush as a JSON document
+const DefaultWebhookTemplate = `{"timestamp":{{.Timestamp}},"metrics":[` +
+	`{{range $i, $m := .Metrics}}{{if $i}},{{end}}` +
+	`{"name":{{json $m.Name}},"value":{{$m.Value}},"timestamp":{{$m.Timestamp}}}` +
+	`{{end}}]}`
+
+// webhookRetryDelay is the delay before the first retry. It doubles after
+// each failed attempt.
+var webhookRetryDelay = time.Second
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// webhookTmpl is the template used to build webhook request bodies
+var webhookTmpl = template.Must(
+	template.New("webhook").Funcs(webhookFuncs).Parse(DefaultWebhookTemplate))
+
+// WebhookData is passed to the webhook body template
+type WebhookData struct {
+	Timestamp int64
+	Metrics   []WebhookMetric
+}
+
+// WebhookMetric is a single flushed metric
+type WebhookMetric struct {
+	Name      string
+	Value     string
+	Timestamp int64
+}
+
+// loadWebhookTemplate replaces the webhook body template with the contents
+// of a file
+func loadWebhookTemplate(path string) error {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	t, err := template.New("webhook").Funcs(webhookFuncs).Parse(string(b))
+
+	if err != nil {
+		return err
+	}
+
+	webhookTmpl = t
+	return nil
+}
+
+// newWebhookData converts a buffer of Graphite plaintext lines into template
+// data
+func newWebhookData(buf []byte, now int64) *WebhookData {
+	data := &WebhookData{Timestamp: now}
+	s := bufio.NewScanner(bytes.NewReader(buf))
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+
+		if len(fields) != 3 {
+			continue
+		}
+
+		ts, err := strconv.ParseInt(fields[2], 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		data.Metrics = append(data.Metrics, WebhookMetric{
+			Name:      fields[0],
+			Value:     fields[1],
+			Timestamp: ts,
+		})
+	}
+
+	return data
+}
+
+// sendWebhook renders the flushed metrics with the webhook template and
+// POSTs them to the webhook URL, retrying failed requests
+func sendWebhook(buf []byte, now int64) {
+	var body bytes.Buffer
+
+	if err := webhookTmpl.Execute(&body, newWebhookData(buf, now)); err != nil {
+		logError("Unable to render webhook template", "error", err)
+		return
+	}
+
+	client := &http.Client{Timeout: *webhookTimeout}
+	t0 := time.Now()
+
+	err := withRetries("Webhook", *webhookRetries, func() error {
+		return postWebhook(client, body.Bytes())
+	})
+
+	if err != nil {
+		logError("Unable to send metrics to webhook", "error", err)
+		return
+	}
+
+	logInfo("Finished sending metrics to webhook", "bytes", body.Len(),
+		"url", *webhookURL, "duration", time.Now().Sub(t0))
+}
+
+// withRetries calls f until it succeeds, retrying up to retries times with
+// a delay that starts at webhookRetryDelay and doubles after each failure.
+// It returns the last error if every attempt fails.
+func withRetries(name string, retries int, f func() error) error {
+	delay := webhookRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		err := f()
+
+		if err == nil || attempt >= retries {
+			return err
+		}
+
+		logError(name+" request failed", "retry", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postWebhook makes a single webhook request
+func postWebhook(client *http.Client, body []byte) error {
+	resp, err := client.Post(*webhookURL, "application/json",
+		bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestSendWebhook(t *testing.T) {
+	var requests int
+	var body string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		// Fail the first request to exercise the retry
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer ts.Close()
+
+	f, err := ioutil.TempFile("", "webhook")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+	f.WriteString(`{{range .Metrics}}{{.Name}}={{.Value}};{{end}}@{{.Timestamp}}`)
+	f.Close()
+
+	defer func(t *template.Template) { webhookTmpl = t }(webhookTmpl)
+	defer func(u string, d time.Duration) {
+		*webhookURL = u
+		webhookRetryDelay = d
+	}(*webhookURL, webhookRetryDelay)
+
+	if err := loadWebhookTemplate(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	*webhookURL = ts.URL
+	webhookRetryDelay = time.Millisecond
+	sendWebhook([]byte("foo 1 100\nbar.mean 2.500000 100\n"), 100)
+
+	if requests != 2 {
+		t.Errorf("sendWebhook: got %d requests, want 2", requests)
+	}
+
+	want := "foo=1;bar.mean=2.500000;@100"
+
+	if body != want {
+		t.Errorf("sendWebhook: got body %q, want %q", body, want)
+	}
+}
+
+func TestDefaultWebhookTemplate(t *testing.T) {
+	defer func(u string) { *webhookURL = u }(*webhookURL)
+	var body string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer ts.Close()
+
+	*webhookURL = ts.URL
+	sendWebhook([]byte("foo 1 100\n"), 100)
+
+	want := `{"timestamp":100,"metrics":[{"name":"foo","value":1,"timestamp":100}]}`
+
+	if body != want {
+		t.Errorf("sendWebhook: got body %q, want %q", body, want)
+	}
+}